@@ -0,0 +1,101 @@
+// Package signature generates and verifies the sig= parameter of thumberd URLs.
+//
+// The signature is HMAC-SHA256 over the canonical parameter string, which is
+// every name=value pair except sig, with the name and the value URL-unescaped
+// and escaped again with url.QueryEscape, sorted and joined with ",".
+// So the order of parameters and their escaping do not affect the signature,
+// while a "," or "=" in a value cannot be taken for another pair.
+package signature
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Name is the parameter name which holds the signature.
+const Name = "sig"
+
+// Canonical returns the string to be signed for the given name=value pairs.
+// The sig parameter itself is ignored.
+func Canonical(params []string) string {
+	canonical := make([]string, 0, len(params))
+	for _, param := range params {
+		if param == "" || strings.HasPrefix(param, Name+"=") {
+			continue
+		}
+		nameValue := strings.SplitN(param, "=", 2)
+		for i, s := range nameValue {
+			if unescaped, err := url.QueryUnescape(s); err == nil {
+				s = unescaped
+			}
+			nameValue[i] = url.QueryEscape(s)
+		}
+		canonical = append(canonical, strings.Join(nameValue, "="))
+	}
+	sort.Strings(canonical)
+	return strings.Join(canonical, ",")
+}
+
+// Sign returns the signature of the given name=value pairs.
+func Sign(key []byte, params []string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(Canonical(params)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether sig is a valid signature by any of the keys.
+// Several keys are accepted so that keys can be rotated.
+func Verify(keys [][]byte, params []string, sig string) bool {
+	expected, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	canonical := []byte(Canonical(params))
+	for _, key := range keys {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(canonical)
+		if hmac.Equal(mac.Sum(nil), expected) {
+			return true
+		}
+	}
+	return false
+}
+
+// PresetParam is the parameter which names a preset of thumberd.
+const PresetParam = "preset"
+
+// SplitPath splits a thumberd request path such as
+// "/w=100,h=100?url=http%3A%2F%2Fexample.com%2Fa.jpg" into name=value pairs.
+// The "/p/<name>/" prefix is returned as the preset=<name> pair.
+func SplitPath(path string) []string {
+	path = strings.TrimPrefix(path, "/")
+	preset := ""
+	if strings.HasPrefix(path, "p/") {
+		if i := strings.IndexByte(path[2:], '/'); i >= 0 {
+			preset = path[2 : 2+i]
+			path = path[3+i:]
+		}
+	}
+	pathParam := strings.SplitN(path, "?", 2)
+	params := strings.Split(pathParam[0], ",")
+	if len(pathParam) > 1 {
+		params = append(params, strings.Split(pathParam[1], "&")...)
+	}
+	if preset != "" {
+		params = append(params, PresetParam+"="+preset)
+	}
+	return params
+}
+
+// SignPath returns the request path with the sig parameter appended.
+func SignPath(key []byte, path string) string {
+	sig := Sign(key, SplitPath(path))
+	if strings.Contains(path, "?") {
+		return path + "&" + Name + "=" + sig
+	}
+	return path + "," + Name + "=" + sig
+}
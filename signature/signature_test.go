@@ -0,0 +1,84 @@
+package signature
+
+import (
+	"testing"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	key := []byte("secret")
+	params := SplitPath("/w=100,h=100?url=http%3A%2F%2Fexample.com%2Fa.jpg")
+	sig := Sign(key, params)
+
+	if !Verify([][]byte{key}, params, sig) {
+		t.Error("signature should be valid")
+	}
+	// Order and escaping of the parameters do not matter.
+	if !Verify([][]byte{key}, SplitPath("/h=100,url=http://example.com/a.jpg,w=100"), sig) {
+		t.Error("signature should be valid for reordered parameters")
+	}
+	if Verify([][]byte{key}, SplitPath("/w=200,h=100?url=http%3A%2F%2Fexample.com%2Fa.jpg"), sig) {
+		t.Error("signature should be invalid for modified parameters")
+	}
+	if Verify([][]byte{[]byte("other")}, params, sig) {
+		t.Error("signature should be invalid for another key")
+	}
+	if Verify([][]byte{key}, params, "!!!") {
+		t.Error("malformed signature should be invalid")
+	}
+}
+
+func TestCanonicalIsUnambiguous(t *testing.T) {
+	// 値に含まれる "," や "=" を別のパラメータの区切りと取り違えない
+	key := []byte("secret")
+	for _, c := range [][2][]string{
+		{{"t=x%2Cw%3D1"}, {"t=x", "w=1"}},
+		{{"t=a%3Db"}, {"t%3Da=b"}},
+		{{"url=example.com%2Fa.jpg%2Cw%3D1"}, {"url=example.com/a.jpg", "w=1"}},
+	} {
+		if Canonical(c[0]) == Canonical(c[1]) {
+			t.Errorf("%q and %q should have different canonical strings: %q", c[0], c[1], Canonical(c[0]))
+		}
+		if Verify([][]byte{key}, c[1], Sign(key, c[0])) {
+			t.Errorf("signature of %q should be invalid for %q", c[0], c[1])
+		}
+	}
+}
+
+func TestVerifyKeyRotation(t *testing.T) {
+	params := []string{"w=100", "url=example.com/a.jpg"}
+	sig := Sign([]byte("old"), params)
+	if !Verify([][]byte{[]byte("new"), []byte("old")}, params, sig) {
+		t.Error("signature by any active key should be valid")
+	}
+}
+
+func TestSignPath(t *testing.T) {
+	key := []byte("secret")
+	for _, path := range []string{
+		"/w=100,h=100,url=example.com/a.jpg",
+		"/w=100?h=100&url=example.com%2Fa.jpg",
+	} {
+		signed := SignPath(key, path)
+		params := SplitPath(signed)
+		sig := ""
+		for _, p := range params {
+			if len(p) > len(Name)+1 && p[:len(Name)+1] == Name+"=" {
+				sig = p[len(Name)+1:]
+			}
+		}
+		if !Verify([][]byte{key}, params, sig) {
+			t.Errorf("signed path should be valid: %s", signed)
+		}
+	}
+}
+
+func TestSplitPathWithPreset(t *testing.T) {
+	params := SplitPath("/p/thumb/url=example.com%2Fa.jpg,w=100")
+	if len(params) != 3 || params[0] != "url=example.com%2Fa.jpg" || params[1] != "w=100" || params[2] != "preset=thumb" {
+		t.Errorf("unexpected params %q", params)
+	}
+	// The prefix and the parameter are signed the same.
+	if Canonical(params) != Canonical(SplitPath("/preset=thumb,w=100?url=example.com%2Fa.jpg")) {
+		t.Error("/p/<name>/ should be the same as preset=<name>")
+	}
+}
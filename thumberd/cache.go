@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/smartnews/yoya-thumber/thumbnail"
+)
+
+// Cache stores rendered thumbnails.
+type Cache interface {
+	Get(key string) (*cacheEntry, bool)
+	Set(key string, entry *cacheEntry)
+}
+
+type cacheEntry struct {
+	ContentType  string
+	ETag         string
+	LastModified string
+	Body         []byte
+}
+
+func (e *cacheEntry) size() int64 {
+	return int64(len(e.ContentType) + len(e.ETag) + len(e.LastModified) + len(e.Body))
+}
+
+/*
+ *  ディスクキャッシュのファイルの先頭行 (Content-Type, ETag, Last-Modified をタブ区切り)
+ *  ETag 対応前のファイルは Content-Type だけなので、そのまま読める。
+ */
+func (e *cacheEntry) headerLine() string {
+	return e.ContentType + "\t" + e.ETag + "\t" + e.LastModified + "\n"
+}
+
+func parseCacheFile(buf []byte) (*cacheEntry, bool) {
+	n := bytes.IndexByte(buf, '\n')
+	if n < 0 {
+		return nil, false
+	}
+	fields := strings.SplitN(string(buf[:n]), "\t", 3)
+	entry := &cacheEntry{ContentType: fields[0], Body: buf[n+1:]}
+	if len(fields) == 3 {
+		entry.ETag, entry.LastModified = fields[1], fields[2]
+	}
+	return entry, true
+}
+
+// expired reports whether an entry stored at the time is older than ttl (0 means no limit).
+func expired(stored time.Time, ttl time.Duration, now time.Time) bool {
+	return ttl > 0 && now.Sub(stored) >= ttl
+}
+
+// cacheHolder wraps Cache so that atomic.Value can hold a disabled (nil) cache.
+type cacheHolder struct {
+	cache Cache
+}
+
+var thumbCache atomic.Value
+
+func getCache() Cache {
+	h, ok := thumbCache.Load().(*cacheHolder)
+	if !ok {
+		return nil
+	}
+	return h.cache
+}
+
+func newCache(c *tomlConfig) (Cache, error) {
+	if c.Cache.Ttl < 0 {
+		return nil, errors.New("cache.ttl must not be negative")
+	}
+	ttl := time.Duration(c.Cache.Ttl) * time.Second
+	switch c.Cache.Type {
+	case "", "none":
+		return nil, nil
+	case "memory":
+		if c.Cache.MaxBytes <= 0 {
+			return nil, errors.New("cache.max_bytes must be positive")
+		}
+		return newMemoryCache(c.Cache.MaxBytes, ttl), nil
+	case "disk":
+		if c.Cache.MaxBytes <= 0 {
+			return nil, errors.New("cache.max_bytes must be positive")
+		}
+		if c.Cache.Dir == "" {
+			return nil, errors.New("cache.dir is required for disk cache")
+		}
+		return newDiskCache(c.Cache.Dir, c.Cache.MaxBytes, ttl)
+	}
+	return nil, errors.New("unknown cache.type: " + c.Cache.Type)
+}
+
+// setupCache (re)builds the cache only when the [cache] section has changed,
+// so that SIGHUP does not drop the cached thumbnails.
+func setupCache(newConfig, oldConfig *tomlConfig) {
+	if oldConfig != nil && newConfig.Cache == oldConfig.Cache && thumbCache.Load() != nil {
+		return
+	}
+	cache, err := newCache(newConfig)
+	if err != nil {
+		glog.Error("cache setup failed: " + err.Error())
+		cache = nil
+	}
+	thumbCache.Store(&cacheHolder{cache: cache})
+}
+
+/*
+ *  キャッシュや同時リクエストの集約に使うキーの生成
+ *  パース済みのパラメータと正規化した URL から作るので、パラメータの順序や省略形の違いは同じキーになる。
+ *  fo=auto の場合は Accept から決めた候補 (formats) もキーに含める。
+ *  上流には Referer を送るので (Referer で直リンクを制限するサイトがある)、Referer もキーに含める。
+ */
+func requestKey(params thumbnail.ThumbnailParameters, imageUrl string, overlapUrl string, referer string, formats []string) string {
+	params.ImageOverlap = nil
+	params.Timings = nil
+	// SIGHUP で cmyk_profile が変わったら別のキーにする (プロファイルそのものは大きいのでハッシュにする)
+	profile := sha256.Sum256(params.CMYKProfile)
+	params.CMYKProfile = nil
+	params.ImageUrl = imageUrl
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%#v\t%s\t%s\t%v\t%x", params, overlapUrl, referer, formats, profile)))
+	return hex.EncodeToString(sum[:])
+}
+
+/*
+ *  メモリ上の LRU キャッシュ (バイト数で上限を決める)
+ *  ttl を過ぎたエントリは使わずに削除する。
+ */
+type memoryCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	curBytes int64
+	ttl      time.Duration
+	ll       *list.List
+	items    map[string]*list.Element
+	now      func() time.Time
+}
+
+type memoryCacheItem struct {
+	key    string
+	entry  *cacheEntry
+	stored time.Time
+}
+
+func newMemoryCache(maxBytes int64, ttl time.Duration) *memoryCache {
+	return &memoryCache{
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+		now:      time.Now,
+	}
+}
+
+func (c *memoryCache) Get(key string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	item := e.Value.(*memoryCacheItem)
+	if expired(item.stored, c.ttl, c.now()) {
+		c.ll.Remove(e)
+		delete(c.items, key)
+		c.curBytes -= item.entry.size()
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	return item.entry, true
+}
+
+func (c *memoryCache) Set(key string, entry *cacheEntry) {
+	if entry.size() > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.curBytes -= e.Value.(*memoryCacheItem).entry.size()
+		e.Value.(*memoryCacheItem).entry = entry
+		e.Value.(*memoryCacheItem).stored = c.now()
+		c.curBytes += entry.size()
+		c.ll.MoveToFront(e)
+	} else {
+		c.items[key] = c.ll.PushFront(&memoryCacheItem{key: key, entry: entry, stored: c.now()})
+		c.curBytes += entry.size()
+	}
+	for c.curBytes > c.maxBytes {
+		oldest := c.ll.Back()
+		item := oldest.Value.(*memoryCacheItem)
+		c.ll.Remove(oldest)
+		delete(c.items, item.key)
+		c.curBytes -= item.entry.size()
+	}
+}
+
+/*
+ *  ディスク上のキャッシュ (ディレクトリの合計サイズで上限を決める)
+ *  ファイルは <dir>/<key の先頭2文字>/<key> に保存し、1行目に Content-Type、その後に本文を書く。
+ *  保存した日時はファイルの更新日時で、ttl を過ぎたファイルは使わずに削除する。
+ */
+type diskCache struct {
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+	curBytes int64
+	ttl      time.Duration
+	ll       *list.List
+	items    map[string]*list.Element
+	now      func() time.Time
+}
+
+type diskCacheItem struct {
+	key    string
+	size   int64
+	stored time.Time
+}
+
+func newDiskCache(dir string, maxBytes int64, ttl time.Duration) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := &diskCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+		now:      time.Now,
+	}
+
+	/*
+	 *  既存のファイルを更新日時の古い順に読み込む
+	 *  書き込み中に落ちた場合の一時ファイルと、読めないファイルはここで削除する。
+	 *  (SIGHUP で作り直した場合は、前のキャッシュが書き込み中の一時ファイルも消えるが、その書き込みが失敗するだけ)
+	 */
+	var files []os.FileInfo
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		switch {
+		case strings.HasPrefix(info.Name(), ".tmp-"):
+			os.Remove(path)
+		case len(info.Name()) == sha256.Size*2:
+			if path != c.path(info.Name()) || !validCacheFile(path) {
+				glog.Warning("disk cache removes invalid file: " + path)
+				os.Remove(path)
+				return nil
+			}
+			files = append(files, info)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	for _, info := range files {
+		c.items[info.Name()] = c.ll.PushFront(&diskCacheItem{key: info.Name(), size: info.Size(), stored: info.ModTime()})
+		c.curBytes += info.Size()
+	}
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	return c, nil
+}
+
+func (c *diskCache) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key)
+}
+
+// validCacheFile reports whether the file has a hex key name and starts with a header line.
+func validCacheFile(path string) bool {
+	if _, err := hex.DecodeString(filepath.Base(path)); err != nil {
+		return false
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	buf := make([]byte, 4096)
+	n, _ := io.ReadFull(f, buf)
+	return bytes.IndexByte(buf[:n], '\n') >= 0
+}
+
+func (c *diskCache) Get(key string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	e, ok := c.items[key]
+	if ok && expired(e.Value.(*diskCacheItem).stored, c.ttl, c.now()) {
+		c.remove(key)
+		os.Remove(c.path(key))
+		ok = false
+	} else if ok {
+		c.ll.MoveToFront(e)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	buf, err := ioutil.ReadFile(c.path(key))
+	if err != nil {
+		c.mu.Lock()
+		c.remove(key)
+		c.mu.Unlock()
+		return nil, false
+	}
+	entry, ok := parseCacheFile(buf)
+	if !ok {
+		c.mu.Lock()
+		c.remove(key)
+		c.mu.Unlock()
+		os.Remove(c.path(key))
+	}
+	return entry, ok
+}
+
+func (c *diskCache) Set(key string, entry *cacheEntry) {
+	header := entry.headerLine()
+	size := int64(len(header) + len(entry.Body))
+	if size > c.maxBytes {
+		return
+	}
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		glog.Error("disk cache mkdir failed: " + err.Error())
+		return
+	}
+	// 書きかけのファイルを読まないように、一時ファイルに書いてから rename する
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		glog.Error("disk cache write failed: " + err.Error())
+		return
+	}
+	_, err = tmp.Write(append([]byte(header), entry.Body...))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		glog.Error("disk cache write failed: " + err.Error())
+		os.Remove(tmp.Name())
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.curBytes -= e.Value.(*diskCacheItem).size
+		e.Value.(*diskCacheItem).size = size
+		e.Value.(*diskCacheItem).stored = c.now()
+		c.ll.MoveToFront(e)
+	} else {
+		c.items[key] = c.ll.PushFront(&diskCacheItem{key: key, size: size, stored: c.now()})
+	}
+	c.curBytes += size
+	c.evict()
+}
+
+// evict must be called with c.mu held.
+func (c *diskCache) evict() {
+	for c.curBytes > c.maxBytes {
+		oldest := c.ll.Back()
+		key := oldest.Value.(*diskCacheItem).key
+		c.remove(key)
+		os.Remove(c.path(key))
+	}
+}
+
+// remove must be called with c.mu held.
+func (c *diskCache) remove(key string) {
+	e, ok := c.items[key]
+	if !ok {
+		return
+	}
+	c.ll.Remove(e)
+	delete(c.items, key)
+	c.curBytes -= e.Value.(*diskCacheItem).size
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/smartnews/yoya-thumber/thumbnail"
+)
+
+func TestMemoryCacheEviction(t *testing.T) {
+	c := newMemoryCache(20, 0)
+	c.Set("a", &cacheEntry{ContentType: "image/png", Body: []byte("0")})
+	c.Set("b", &cacheEntry{ContentType: "image/png", Body: []byte("1")})
+	if _, ok := c.Get("a"); !ok {
+		t.Error("a should be cached")
+	}
+	// "b" is the least recently used entry now.
+	c.Set("c", &cacheEntry{ContentType: "image/png", Body: []byte("2")})
+	if _, ok := c.Get("b"); ok {
+		t.Error("b should be evicted")
+	}
+	if e, ok := c.Get("c"); !ok || string(e.Body) != "2" {
+		t.Error("c should be cached")
+	}
+	c.Set("d", &cacheEntry{ContentType: "image/png", Body: make([]byte, 100)})
+	if _, ok := c.Get("d"); ok {
+		t.Error("entry larger than max bytes should not be cached")
+	}
+}
+
+func TestDiskCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thumberd-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keys := make([]string, 3)
+	for i := range keys {
+		keys[i] = requestKey(thumbnail.ThumbnailParameters{Width: i}, "http://example.com/a.jpg", "", "", nil)
+	}
+
+	c, err := newDiskCache(dir, 50, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, key := range keys {
+		c.Set(key, &cacheEntry{ContentType: "image/jpeg", Body: []byte(fmt.Sprintf("body-%d-0123456", i))})
+	}
+	if _, ok := c.Get(keys[0]); ok {
+		t.Error("oldest entry should be evicted")
+	}
+	e, ok := c.Get(keys[2])
+	if !ok {
+		t.Fatal("newest entry should be cached")
+	}
+	if e.ContentType != "image/jpeg" || string(e.Body) != "body-2-0123456" {
+		t.Errorf("unexpected entry: %q %q", e.ContentType, e.Body)
+	}
+
+	// Entries survive a restart.
+	c, err = newDiskCache(dir, 50, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Get(keys[2]); !ok {
+		t.Error("entry should be loaded from disk")
+	}
+}
+
+func TestDiskCacheCleanup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thumberd-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c, err := newDiskCache(dir, 1000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := requestKey(thumbnail.ThumbnailParameters{Width: 1}, "http://example.com/a.jpg", "", "", nil)
+	c.Set(valid, &cacheEntry{ContentType: "image/jpeg", Body: []byte("body")})
+	size := c.curBytes
+
+	// 書き込み中に落ちた一時ファイル、ヘッダの無いファイル、別のディレクトリにあるファイル
+	broken := requestKey(thumbnail.ThumbnailParameters{Width: 2}, "http://example.com/a.jpg", "", "", nil)
+	misplaced := requestKey(thumbnail.ThumbnailParameters{Width: 3}, "http://example.com/a.jpg", "", "", nil)
+	garbage := []string{
+		filepath.Join(dir, valid[:2], ".tmp-123456"),
+		c.path(broken),
+		filepath.Join(dir, valid[:2], misplaced),
+	}
+	for _, path := range garbage {
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte("no header"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err = newDiskCache(dir, 1000, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range garbage {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s should be removed: %v", path, err)
+		}
+	}
+	if c.curBytes != size || len(c.items) != 1 {
+		t.Errorf("%d bytes in %d entries, want %d bytes in 1 entry", c.curBytes, len(c.items), size)
+	}
+
+	// 読み込んだ後に壊れたファイルも削除する
+	if err := ioutil.WriteFile(c.path(valid), []byte("no header"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Get(valid); ok {
+		t.Error("broken file should not be used")
+	}
+	if c.curBytes != 0 || len(c.items) != 0 {
+		t.Errorf("broken entry should be removed: %d bytes", c.curBytes)
+	}
+}
+
+func TestRequestKey(t *testing.T) {
+	a := requestKey(thumbnail.ThumbnailParameters{Width: 100, Height: 100}, "http://example.com/a.jpg", "", "", nil)
+	b := requestKey(thumbnail.ThumbnailParameters{Height: 100, Width: 100}, "http://example.com/a.jpg", "", "", nil)
+	if a != b {
+		t.Error("same parameters should have the same key")
+	}
+	if a == requestKey(thumbnail.ThumbnailParameters{Width: 100, Height: 100}, "http://example.com/b.jpg", "", "", nil) {
+		t.Error("different urls should have different keys")
+	}
+	if a == requestKey(thumbnail.ThumbnailParameters{Width: 100, Height: 100}, "http://example.com/a.jpg", "http://example.com/o.png", "", nil) {
+		t.Error("different overlap urls should have different keys")
+	}
+	// 上流に送る Referer が違えば、別の画像が返ることがある
+	if a == requestKey(thumbnail.ThumbnailParameters{Width: 100, Height: 100}, "http://example.com/a.jpg", "", "https://news.example.net/", nil) {
+		t.Error("different referers should have different keys")
+	}
+	if a == requestKey(thumbnail.ThumbnailParameters{Width: 100, Height: 100, CMYKProfile: []byte("profile")}, "http://example.com/a.jpg", "", "", nil) {
+		t.Error("different CMYK profiles should have different keys")
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thumberd-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	disk, err := newDiskCache(dir, 1000, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	memory := newMemoryCache(1000, time.Minute)
+
+	now := time.Now()
+	clock := func() time.Time { return now }
+	memory.now, disk.now = clock, clock
+	key := requestKey(thumbnail.ThumbnailParameters{Width: 100}, "http://example.com/a.jpg", "", "", nil)
+	for _, c := range []Cache{memory, disk} {
+		c.Set(key, &cacheEntry{ContentType: "image/jpeg", Body: []byte("body")})
+	}
+
+	now = now.Add(59 * time.Second)
+	for name, c := range map[string]Cache{"memory": memory, "disk": disk} {
+		if _, ok := c.Get(key); !ok {
+			t.Errorf("%s: entry should be cached within the ttl", name)
+		}
+	}
+	now = now.Add(time.Second)
+	for name, c := range map[string]Cache{"memory": memory, "disk": disk} {
+		if _, ok := c.Get(key); ok {
+			t.Errorf("%s: expired entry should not be used", name)
+		}
+	}
+	if memory.curBytes != 0 || disk.curBytes != 0 {
+		t.Errorf("expired entries should be removed: %d, %d bytes", memory.curBytes, disk.curBytes)
+	}
+	if _, err := os.Stat(disk.path(key)); !os.IsNotExist(err) {
+		t.Errorf("expired file should be removed: %v", err)
+	}
+}
+
+func TestParseCacheFile(t *testing.T) {
+	entry := &cacheEntry{ContentType: "image/jpeg", ETag: `"abc-def"`, LastModified: "Mon, 02 Jan 2006 15:04:05 GMT", Body: []byte("body\n")}
+	e, ok := parseCacheFile(append([]byte(entry.headerLine()), entry.Body...))
+	if !ok || e.ContentType != entry.ContentType || e.ETag != entry.ETag || e.LastModified != entry.LastModified || string(e.Body) != "body\n" {
+		t.Errorf("unexpected entry: %+v", e)
+	}
+
+	// ETag 対応前のファイル
+	e, ok = parseCacheFile([]byte("image/png\nbody"))
+	if !ok || e.ContentType != "image/png" || e.ETag != "" || string(e.Body) != "body" {
+		t.Errorf("unexpected entry: %+v", e)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+/*
+ *  同一リクエストの集約 (singleflight)
+ *  同じキーの処理が実行中なら、新たに実行せずにその結果を待つ。
+ */
+
+type flightCall struct {
+	wg     sync.WaitGroup
+	result *thumbResult
+	dups   int // 結果を待っている呼び出しの数
+}
+
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+var thumbFlights = &flightGroup{calls: make(map[string]*flightCall)}
+
+// do runs fn once for concurrent callers with the same key.
+// shared reports whether the result came from another caller's fn.
+func (g *flightGroup) do(key string, fn func() *thumbResult) (result *thumbResult, shared bool) {
+	g.mu.Lock()
+	if call, ok := g.calls[key]; ok {
+		call.dups++
+		g.mu.Unlock()
+		call.wg.Wait()
+		return call.result, true
+	}
+	call := new(flightCall)
+	call.wg.Add(1)
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	defer func() {
+		// fn が panic しても待っている側を解放する
+		if call.result == nil {
+			call.result = errorResult(http.StatusInternalServerError, "Thumbnail failed", &http_stats.thumb_error)
+		}
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		call.wg.Done()
+	}()
+	call.result = fn()
+	return call.result, false
+}
+
+/*
+ *  集約先のクライアントが処理前に切断した場合 (canceled) は、ctx が有効な間は do をやり直す。
+ *  待っていた呼び出しのうち1つが新しく処理して、残りはその結果を待つ。
+ *  shared は最初の do の結果を返す。
+ */
+func (g *flightGroup) doAlive(ctx context.Context, key string, fn func() *thumbResult) (result *thumbResult, shared bool) {
+	result, shared = g.do(key, fn)
+	for again := shared; again && result.stat == &http_stats.canceled && ctx.Err() == nil; {
+		result, again = g.do(key, fn)
+	}
+	return result, shared
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestFlightGroup(t *testing.T) {
+	g := &flightGroup{calls: make(map[string]*flightCall)}
+	var calls int64
+	var shared int64
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	var wg sync.WaitGroup
+	run := func() {
+		defer wg.Done()
+		result, s := g.do("key", func() *thumbResult {
+			atomic.AddInt64(&calls, 1)
+			close(started)
+			<-release
+			return &thumbResult{body: []byte("body")}
+		})
+		if string(result.body) != "body" {
+			t.Errorf("unexpected body: %q", result.body)
+		}
+		if s {
+			atomic.AddInt64(&shared, 1)
+		}
+	}
+
+	wg.Add(1)
+	go run()
+	<-started
+	for i := 0; i < 9; i++ {
+		wg.Add(1)
+		go run()
+	}
+	// wait until the other callers are waiting for the first one
+	for {
+		g.mu.Lock()
+		dups := g.calls["key"].dups
+		g.mu.Unlock()
+		if dups == 9 {
+			break
+		}
+		runtime.Gosched()
+	}
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("fn should be called once, but called %d times", calls)
+	}
+	if shared != 9 {
+		t.Errorf("9 callers should share the result, got %d", shared)
+	}
+	if len(g.calls) != 0 {
+		t.Error("finished calls should be removed")
+	}
+}
+
+func TestFlightGroupPanic(t *testing.T) {
+	g := &flightGroup{calls: make(map[string]*flightCall)}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("panic should be propagated")
+			}
+		}()
+		g.do("key", func() *thumbResult { panic("boom") })
+	}()
+	if len(g.calls) != 0 {
+		t.Error("panicked calls should be removed")
+	}
+}
+
+// waitDups waits until n callers are waiting for the call of the key.
+func waitDups(g *flightGroup, key string, n int) {
+	for {
+		g.mu.Lock()
+		call, ok := g.calls[key]
+		dups := 0
+		if ok {
+			dups = call.dups
+		}
+		g.mu.Unlock()
+		if dups == n {
+			return
+		}
+		runtime.Gosched()
+	}
+}
+
+func TestFlightGroupCanceledLeader(t *testing.T) {
+	g := &flightGroup{calls: make(map[string]*flightCall)}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	go g.do("key", func() *thumbResult {
+		close(started)
+		<-release
+		return canceledResult(context.Canceled)
+	})
+	<-started
+
+	// 切断したリーダーの代わりに、待っていた中の1つだけが処理し直す
+	var calls int64
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, shared := g.doAlive(context.Background(), "key", func() *thumbResult {
+				atomic.AddInt64(&calls, 1)
+				waitDups(g, "key", 4)
+				return &thumbResult{body: []byte("body")}
+			})
+			if !shared || string(result.body) != "body" {
+				t.Errorf("shared = %t, body = %q", shared, result.body)
+			}
+		}()
+	}
+	waitDups(g, "key", 5)
+	close(release)
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("fn should be called once by a new leader, but called %d times", calls)
+	}
+
+	// 自分のクライアントも切断していれば処理し直さない
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	started = make(chan struct{})
+	release = make(chan struct{})
+	go g.do("key", func() *thumbResult {
+		close(started)
+		<-release
+		return canceledResult(context.Canceled)
+	})
+	<-started
+	done := make(chan *thumbResult)
+	go func() {
+		result, _ := g.doAlive(ctx, "key", func() *thumbResult {
+			t.Error("fn should not be called for a canceled request")
+			return nil
+		})
+		done <- result
+	}()
+	waitDups(g, "key", 1)
+	close(release)
+	if result := <-done; result.stat != &http_stats.canceled {
+		t.Errorf("stat = %p", result.stat)
+	}
+}
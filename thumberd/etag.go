@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+/*
+ *  ETag と条件付きリクエスト
+ *  ETag は正規化したパラメータ (requestKey) と上流の ETag / Last-Modified から作る。
+ *  上流の値を ETag に埋め込んでおくので、クライアントの If-None-Match から上流への条件付きリクエストを組み立てられる。
+ *  (上書き画像 io の変更は ETag に反映されない)
+ */
+
+// ETag に含める requestKey の長さ
+const etagKeyLength = 16
+
+/*
+ *  上流のレスポンスヘッダからサムネールの ETag を作る。
+ *  形式は "<key>-<base64("e" + 上流の ETag または "m" + Last-Modified)>"。上流の ETag が弱い場合は弱い ETag にする。
+ *  上流に ETag も Last-Modified も無い場合は "" を返す。
+ */
+func thumbnailETag(key string, origin http.Header) string {
+	var validator string
+	weak := false
+	if etag := origin.Get("ETag"); etag != "" {
+		validator = "e" + etag
+		weak = strings.HasPrefix(etag, "W/")
+	} else if lastModified := origin.Get("Last-Modified"); lastModified != "" {
+		validator = "m" + lastModified
+	} else {
+		return ""
+	}
+	tag := `"` + key[:etagKeyLength] + "-" + base64.RawURLEncoding.EncodeToString([]byte(validator)) + `"`
+	if weak {
+		return "W/" + tag
+	}
+	return tag
+}
+
+// bodyETag is the ETag for origins without validators: "<key>.<hash of the thumbnail>".
+func bodyETag(key string, body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + key[:etagKeyLength] + "." + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// parseETags splits the value of If-None-Match. Commas inside quotes are kept.
+func parseETags(header string) []string {
+	var tags []string
+	start := 0
+	quoted := false
+	for i := 0; i <= len(header); i++ {
+		if i == len(header) || (header[i] == ',' && !quoted) {
+			if tag := strings.TrimSpace(header[start:i]); tag != "" {
+				tags = append(tags, tag)
+			}
+			start = i + 1
+		} else if header[i] == '"' {
+			quoted = !quoted
+		}
+	}
+	return tags
+}
+
+func isValidHeaderValue(v string) bool {
+	for i := 0; i < len(v); i++ {
+		if v[i] < 0x20 || v[i] == 0x7F {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ *  クライアントの条件付きリクエストのヘッダから、上流に送るヘッダを作る。
+ *  If-None-Match は key が一致する ETag から上流の値を取り出す。
+ *  If-Modified-Since は Last-Modified が上流と同じなので、If-None-Match が無い場合はそのまま送る。
+ */
+func originConditions(r *http.Request, key string) http.Header {
+	conditions := make(http.Header)
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	if ifNoneMatch == "" {
+		if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+			conditions.Set("If-Modified-Since", ims)
+		}
+		return conditions
+	}
+
+	var etags []string
+	for _, tag := range parseETags(ifNoneMatch) {
+		opaque := strings.Trim(strings.TrimPrefix(tag, "W/"), `"`)
+		if len(opaque) <= etagKeyLength || opaque[:etagKeyLength] != key[:etagKeyLength] || opaque[etagKeyLength] != '-' {
+			continue
+		}
+		validator, err := base64.RawURLEncoding.DecodeString(opaque[etagKeyLength+1:])
+		if err != nil || len(validator) < 2 || !isValidHeaderValue(string(validator)) {
+			continue
+		}
+		switch validator[0] {
+		case 'e':
+			etags = append(etags, string(validator[1:]))
+		case 'm':
+			conditions.Set("If-Modified-Since", string(validator[1:]))
+		}
+	}
+	if len(etags) > 0 {
+		conditions.Set("If-None-Match", strings.Join(etags, ", "))
+	}
+	return conditions
+}
+
+/*
+ *  クライアントのキャッシュが有効かを判定する。
+ *  If-None-Match がある場合は If-Modified-Since を見ない。(RFC 7232)
+ */
+func notModified(r *http.Request, etag, lastModified string) bool {
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if etag == "" {
+			return false
+		}
+		for _, tag := range parseETags(ifNoneMatch) {
+			// If-None-Match は弱い比較
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	ims := r.Header.Get("If-Modified-Since")
+	if ims == "" || lastModified == "" {
+		return false
+	}
+	since, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(lastModified)
+	if err != nil {
+		return false
+	}
+	return !modified.After(since)
+}
+
+func setValidators(h http.Header, etag, lastModified, cacheControl string) {
+	if etag != "" {
+		h.Set("ETag", etag)
+	}
+	if lastModified != "" {
+		h.Set("Last-Modified", lastModified)
+	}
+	if cacheControl != "" {
+		h.Set("Cache-Control", cacheControl)
+	}
+}
+
+func writeNotModified(w http.ResponseWriter, etag, lastModified, cacheControl string) {
+	setValidators(w.Header(), etag, lastModified, cacheControl)
+	w.WriteHeader(http.StatusNotModified)
+	atomic.AddInt64(&http_stats.not_modified, 1)
+}
+
+/*
+ *  上流に条件付きリクエストを送る。上流が 304 を返した場合は、クライアントに返す ETag と Last-Modified を返す。
+ *  変わっていた場合は ok = false を返す。上流が 200 で画像を返した場合は、取得し直さずに変換できるように
+ *  fresh として返すので、呼び出し側で Body を Close する。
+ */
+func revalidate(r *http.Request, c *tomlConfig, imageUrl, key string) (etag, lastModified string, fresh *http.Response, ok bool) {
+	conditions := originConditions(r, key)
+	if len(conditions) == 0 {
+		return "", "", nil, false
+	}
+	res, err, status := myClientImageGet(r.Context(), imageUrl, r.Referer(), c.Http.UserAgent, c.Http.Accept, conditions)
+	if err != nil {
+		return "", "", nil, false
+	}
+	if status != http.StatusNotModified {
+		return "", "", res, false
+	}
+	res.Body.Close()
+
+	// 304 に ETag も Last-Modified も無い場合は、送った値のままとみなす
+	origin := res.Header
+	if origin.Get("ETag") == "" && origin.Get("Last-Modified") == "" {
+		origin = make(http.Header)
+		if etags := parseETags(conditions.Get("If-None-Match")); len(etags) == 1 {
+			origin.Set("ETag", etags[0])
+		} else if len(etags) == 0 {
+			origin.Set("Last-Modified", conditions.Get("If-Modified-Since"))
+		} else {
+			return "", "", nil, false
+		}
+	}
+	return thumbnailETag(key, origin), origin.Get("Last-Modified"), nil, true
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+const testKey = "0123456789abcdef0123456789abcdef"
+
+func TestThumbnailETag(t *testing.T) {
+	strong := thumbnailETag(testKey, http.Header{"Etag": {`"v1"`}, "Last-Modified": {"Mon, 02 Jan 2006 15:04:05 GMT"}})
+	if !strings.HasPrefix(strong, `"0123456789abcdef-`) {
+		t.Errorf("unexpected ETag %s", strong)
+	}
+	if weak := thumbnailETag(testKey, http.Header{"Etag": {`W/"v1"`}}); !strings.HasPrefix(weak, `W/"`) {
+		t.Errorf("weak origin ETag should make a weak ETag, got %s", weak)
+	}
+	if strong == thumbnailETag(testKey, http.Header{"Etag": {`"v2"`}}) {
+		t.Error("different origin ETags should have different ETags")
+	}
+	if strong == thumbnailETag("fedcba9876543210", http.Header{"Etag": {`"v1"`}}) {
+		t.Error("different parameters should have different ETags")
+	}
+	if etag := thumbnailETag(testKey, http.Header{}); etag != "" {
+		t.Errorf("ETag without origin validators should be empty, got %s", etag)
+	}
+	if bodyETag(testKey, []byte("a")) == bodyETag(testKey, []byte("b")) {
+		t.Error("different bodies should have different ETags")
+	}
+}
+
+func TestParseETags(t *testing.T) {
+	tags := parseETags(` "a", W/"b,c" ,"d"`)
+	if len(tags) != 3 || tags[0] != `"a"` || tags[1] != `W/"b,c"` || tags[2] != `"d"` {
+		t.Errorf("unexpected tags %q", tags)
+	}
+}
+
+func TestOriginConditions(t *testing.T) {
+	lastModified := "Mon, 02 Jan 2006 15:04:05 GMT"
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("If-None-Match", thumbnailETag(testKey, http.Header{"Etag": {`"v1"`}})+", "+
+		thumbnailETag(testKey, http.Header{"Etag": {`W/"v2"`}})+", "+
+		thumbnailETag("fedcba9876543210", http.Header{"Etag": {`"other"`}})+`, "garbage"`)
+	conditions := originConditions(r, testKey)
+	if got := conditions.Get("If-None-Match"); got != `"v1", W/"v2"` {
+		t.Errorf("If-None-Match = %s", got)
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("If-None-Match", thumbnailETag(testKey, http.Header{"Last-Modified": {lastModified}}))
+	r.Header.Set("If-Modified-Since", "Sun, 01 Jan 2006 00:00:00 GMT")
+	conditions = originConditions(r, testKey)
+	if conditions.Get("If-Modified-Since") != lastModified || conditions.Get("If-None-Match") != "" {
+		t.Errorf("unexpected conditions %v", conditions)
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("If-Modified-Since", lastModified)
+	if conditions = originConditions(r, testKey); conditions.Get("If-Modified-Since") != lastModified {
+		t.Errorf("If-Modified-Since should be forwarded, got %v", conditions)
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("If-None-Match", `"`+testKey[:etagKeyLength]+`-ZQ0KWC1JbmplY3Q6IDE"`) // "e\r\nX-Inject: 1"
+	if conditions = originConditions(r, testKey); len(conditions) != 0 {
+		t.Errorf("control characters should be rejected, got %v", conditions)
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	lastModified := "Mon, 02 Jan 2006 15:04:05 GMT"
+	cases := []struct {
+		ifNoneMatch, ifModifiedSince string
+		want                         bool
+	}{
+		{`"a"`, "", true},
+		{`"b", W/"a"`, "", true},
+		{"*", "", true},
+		{`"b"`, "", false},
+		// If-None-Match がある場合は If-Modified-Since を見ない
+		{`"b"`, lastModified, false},
+		{"", lastModified, true},
+		{"", "Tue, 03 Jan 2006 00:00:00 GMT", true},
+		{"", "Sun, 01 Jan 2006 00:00:00 GMT", false},
+		{"", "invalid", false},
+		{"", "", false},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		if c.ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", c.ifNoneMatch)
+		}
+		if c.ifModifiedSince != "" {
+			r.Header.Set("If-Modified-Since", c.ifModifiedSince)
+		}
+		if got := notModified(r, `"a"`, lastModified); got != c.want {
+			t.Errorf("If-None-Match:%q If-Modified-Since:%q = %v, want %v", c.ifNoneMatch, c.ifModifiedSince, got, c.want)
+		}
+	}
+}
+
+func TestThumbServerNotModified(t *testing.T) {
+	// 上流は変わっていないので、画像を返さずに 304 を返す
+	var received http.Header
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+		if r.Header.Get("If-None-Match") == `"v1"` || r.Header.Get("If-Modified-Since") != "" {
+			w.Header().Set("ETag", `"v1"`)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		http.Error(w, "should not be requested without conditions", http.StatusInternalServerError)
+	}))
+	defer origin.Close()
+	host, restore := useTestOrigin(t, origin)
+	defer restore()
+	oldConfig := config.Load().(*tomlConfig)
+	c := *oldConfig
+	c.Http.CacheControl = "public, max-age=60"
+	config.Store(&c)
+	defer config.Store(oldConfig)
+
+	ts := httptest.NewServer(newTestHandler())
+	defer ts.Close()
+	get := func(header, value string) *http.Response {
+		req, _ := http.NewRequest("GET", ts.URL+"/w=100,url="+host+"/a.jpg", nil)
+		req.Header.Set(header, value)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	res := get("If-Modified-Since", "Mon, 02 Jan 2006 15:04:05 GMT")
+	if res.StatusCode != http.StatusNotModified {
+		t.Fatalf("status should be 304, got %d", res.StatusCode)
+	}
+	if received.Get("If-Modified-Since") != "Mon, 02 Jan 2006 15:04:05 GMT" {
+		t.Errorf("If-Modified-Since should be forwarded, got %v", received)
+	}
+	if res.Header.Get("Cache-Control") != "public, max-age=60" {
+		t.Errorf("Cache-Control = %q", res.Header.Get("Cache-Control"))
+	}
+	etag := res.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("ETag should be set")
+	}
+
+	// ETag に含まれている上流の ETag で問い合わせる
+	res = get("If-None-Match", etag)
+	if res.StatusCode != http.StatusNotModified || res.Header.Get("ETag") != etag {
+		t.Errorf("status should be 304 with the same ETag, got %d %s", res.StatusCode, res.Header.Get("ETag"))
+	}
+	if received.Get("If-None-Match") != `"v1"` {
+		t.Errorf("If-None-Match should be the origin ETag, got %v", received)
+	}
+}
+
+func TestThumbServerModifiedFetchesOnce(t *testing.T) {
+	// 上流が変わっていた場合は、条件付きリクエストの 200 から変換して取り直さない
+	var requests int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("ETag", `"v2"`)
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Write([]byte("not an image"))
+	}))
+	defer origin.Close()
+	host, restore := useTestOrigin(t, origin)
+	defer restore()
+
+	ts := httptest.NewServer(newTestHandler())
+	defer ts.Close()
+	req, _ := http.NewRequest("GET", ts.URL+"/w=100,url="+host+"/b.jpg", nil)
+	req.Header.Set("If-Modified-Since", "Mon, 02 Jan 2006 15:04:05 GMT")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode == http.StatusNotModified {
+		t.Fatal("status should not be 304")
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("origin should be requested once, got %d", n)
+	}
+}
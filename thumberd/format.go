@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+/*
+ *  出力フォーマットの選択
+ *  fo=auto の場合は Accept ヘッダ、元画像の透明度、設定の優先順位から出力フォーマットを決める。
+ */
+
+// Output formats probed at startup, in the order shown on /server-status.
+var outputFormatNames = []string{"jpeg", "png", "gif", "webp", "heic", "avif", "jxl"}
+
+// outputFormats is the result of the startup probe. It is not modified afterwards.
+var outputFormats map[string]bool
+
+var formatContentTypes = map[string]string{
+	"jpg":  "image/jpeg",
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"gif":  "image/gif",
+	"webp": "image/webp",
+	"heic": "image/heic",
+	"heif": "image/heic",
+	"avif": "image/avif",
+	"jxl":  "image/jxl",
+}
+
+// canonicalFormat maps aliases such as "jpg" to the names in outputFormatNames.
+func canonicalFormat(format string) string {
+	switch format {
+	case "jpg":
+		return "jpeg"
+	case "heif":
+		return "heic"
+	}
+	return format
+}
+
+// Used when format_preference in [image] is empty.
+var defaultFormatPreference = []string{"avif", "jxl", "webp"}
+
+// Formats which every client can display, so they need not be listed in Accept.
+func isBaselineFormat(format string) bool {
+	return format == "jpeg" || format == "png"
+}
+
+func keepsTransparency(format string) bool {
+	switch format {
+	case "png", "gif", "webp", "heic", "avif", "jxl":
+		return true
+	}
+	return false
+}
+
+// parseAccept returns the q-values of the media types in the Accept header.
+func parseAccept(accept string) map[string]float64 {
+	types := make(map[string]float64)
+	for _, item := range strings.Split(accept, ",") {
+		fields := strings.Split(item, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(fields[0]))
+		if mediaType == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		types[mediaType] = q
+	}
+	return types
+}
+
+/*
+ * fo=auto の候補を優先順に返す。
+ * 起動時に書き出せなかったフォーマットと、Accept に明示されていないフォーマットは除く。
+ * (ワイルドカードでは avif などに対応しているか分からないので、明示されたものだけを使う)
+ */
+func autoFormats(accept string, preference []string, supported map[string]bool) []string {
+	if len(preference) == 0 {
+		preference = defaultFormatPreference
+	}
+	accepted := parseAccept(accept)
+	var formats []string
+	for _, format := range preference {
+		format = canonicalFormat(strings.ToLower(format))
+		if !supported[format] {
+			continue
+		}
+		if !isBaselineFormat(format) && accepted[formatContentTypes[format]] <= 0 {
+			continue
+		}
+		formats = append(formats, format)
+	}
+	return formats
+}
+
+// chooseFormat picks the first candidate which can keep the transparency
+// of the source, falling back to png or jpeg.
+func chooseFormat(candidates []string, hasAlpha bool) string {
+	for _, format := range candidates {
+		if !hasAlpha || keepsTransparency(format) {
+			return format
+		}
+	}
+	if hasAlpha {
+		return "png"
+	}
+	return "jpeg"
+}
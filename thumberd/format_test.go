@@ -0,0 +1,59 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseAccept(t *testing.T) {
+	got := parseAccept("image/avif,image/webp;q=0.9, image/*;q=0.8,*/*;q=0")
+	want := map[string]float64{"image/avif": 1, "image/webp": 0.9, "image/*": 0.8, "*/*": 0}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseAccept = %v, want %v", got, want)
+	}
+}
+
+func TestAutoFormats(t *testing.T) {
+	all := map[string]bool{"jpeg": true, "png": true, "webp": true, "avif": true, "jxl": true}
+	cases := []struct {
+		accept     string
+		preference []string
+		supported  map[string]bool
+		want       []string
+	}{
+		{"image/avif,image/webp,image/apng,image/*,*/*;q=0.8", nil, all, []string{"avif", "webp"}},
+		// image/* だけでは avif などに対応しているか分からない
+		{"image/*,*/*;q=0.8", nil, all, nil},
+		{"image/jxl,image/avif,image/webp", nil, all, []string{"avif", "jxl", "webp"}},
+		{"image/avif;q=0,image/webp", nil, all, []string{"webp"}},
+		{"image/avif,image/webp", []string{"webp", "avif"}, all, []string{"webp", "avif"}},
+		{"image/avif,image/webp", []string{"avif", "png"}, all, []string{"avif", "png"}},
+		// 起動時に書き出せなかったフォーマットは使わない
+		{"image/avif,image/webp", nil, map[string]bool{"webp": true}, []string{"webp"}},
+	}
+	for _, c := range cases {
+		if got := autoFormats(c.accept, c.preference, c.supported); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("autoFormats(%q, %v) = %v, want %v", c.accept, c.preference, got, c.want)
+		}
+	}
+}
+
+func TestChooseFormat(t *testing.T) {
+	cases := []struct {
+		candidates []string
+		hasAlpha   bool
+		want       string
+	}{
+		{[]string{"avif", "webp"}, false, "avif"},
+		{[]string{"avif", "webp"}, true, "avif"},
+		{[]string{"jpeg", "webp"}, true, "webp"},
+		{[]string{"jpeg"}, true, "png"},
+		{nil, false, "jpeg"},
+		{nil, true, "png"},
+	}
+	for _, c := range cases {
+		if got := chooseFormat(c.candidates, c.hasAlpha); got != c.want {
+			t.Errorf("chooseFormat(%v, %v) = %q, want %q", c.candidates, c.hasAlpha, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/smartnews/yoya-thumber/thumbnail"
+)
+
+/*
+ *  ヘルスチェック
+ *  /healthz (liveness) はプロセスが動いていれば 200 (終了処理中は 503)。
+ *  /readyz (readiness) は設定、delegate、ImageMagick での変換、セマフォの待ち時間を確認する。
+ */
+
+const defaultReadyMaxQueueWait = time.Second
+
+// Output formats which must be available for the instance to be ready.
+var requiredFormats = []string{"jpeg", "png", "webp", "heic"}
+
+// readyImage is an 8x8 PNG rendered by the readiness check.
+var readyImage = []byte{
+	0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a, 0x00, 0x00, 0x00, 0x0d,
+	0x49, 0x48, 0x44, 0x52, 0x00, 0x00, 0x00, 0x08, 0x00, 0x00, 0x00, 0x08,
+	0x08, 0x02, 0x00, 0x00, 0x00, 0x4b, 0x6d, 0x29, 0xdc, 0x00, 0x00, 0x00,
+	0x1a, 0x49, 0x44, 0x41, 0x54, 0x78, 0xda, 0x62, 0x61, 0x60, 0x68, 0x50,
+	0x60, 0x60, 0xc0, 0x44, 0x2c, 0x0c, 0x0a, 0x0c, 0x58, 0xc1, 0xe0, 0x94,
+	0x00, 0x0c, 0x00, 0x6a, 0xc7, 0x02, 0x61, 0xf4, 0x94, 0xa0, 0x91, 0x00,
+	0x00, 0x00, 0x00, 0x49, 0x45, 0x4e, 0x44, 0xae, 0x42, 0x60, 0x82,
+}
+
+type readyCheck struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+type readyStatus struct {
+	Status string       `json:"status"`
+	Checks []readyCheck `json:"checks"`
+}
+
+func healthServer(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	if isShuttingDown() {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
+
+func checkConfig() readyCheck {
+	if _, ok := config.Load().(*tomlConfig); !ok {
+		return readyCheck{Name: "config", OK: false, Message: "config is not loaded"}
+	}
+	return readyCheck{Name: "config", OK: true}
+}
+
+func checkDelegates(supported map[string]bool) readyCheck {
+	var missing []string
+	for _, format := range requiredFormats {
+		if !supported[format] {
+			missing = append(missing, format)
+		}
+	}
+	if len(missing) > 0 {
+		return readyCheck{Name: "delegates", OK: false, Message: "missing " + strings.Join(missing, ",")}
+	}
+	return readyCheck{Name: "delegates", OK: true}
+}
+
+/*
+ *  ImageMagick のワーカーを待って (queue)、小さな画像を変換する (render)。
+ *  maxWait 以内にセマフォを取れない場合は、変換せずに queue を失敗にする。
+ */
+func checkRender(sem chan int, maxWait time.Duration) (queue readyCheck, render readyCheck) {
+	start := time.Now()
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+	select {
+	case sem <- 1:
+	case <-timer.C:
+		queue = readyCheck{Name: "queue", OK: false, Message: "waited more than " + maxWait.String()}
+		render = readyCheck{Name: "render", OK: false, Message: "skipped"}
+		return
+	}
+	queue = readyCheck{Name: "queue", OK: true, Message: "waited " + time.Since(start).String()}
+
+	buf := newResponseBuffer()
+	err := thumbnail.MakeThumbnailMagick(readyImage, buf, thumbnail.ThumbnailParameters{
+		Width:        4,
+		Height:       4,
+		Quality:      80,
+		Background:   "#ffffff",
+		FormatOutput: "jpeg",
+		MaxPixels:    maxPixels,
+	})
+	<-sem
+
+	body := buf.body.Bytes()
+	switch {
+	case err != nil:
+		render = readyCheck{Name: "render", OK: false, Message: err.Error()}
+	case len(body) < 2 || !isJPEG(body):
+		render = readyCheck{Name: "render", OK: false, Message: "unexpected output"}
+	default:
+		render = readyCheck{Name: "render", OK: true}
+	}
+	return
+}
+
+func (h *Handler) readyServer(w http.ResponseWriter, r *http.Request) {
+	maxWait := defaultReadyMaxQueueWait
+	if c, ok := config.Load().(*tomlConfig); ok && c.Health.MaxQueueWaitMs > 0 {
+		maxWait = time.Duration(c.Health.MaxQueueWaitMs) * time.Millisecond
+	}
+
+	status := readyStatus{Status: "ok"}
+	shutdown := readyCheck{Name: "shutdown", OK: true}
+	if isShuttingDown() {
+		shutdown = readyCheck{Name: "shutdown", OK: false, Message: "shutting down"}
+	}
+	queue, render := checkRender(h.sem, maxWait)
+	status.Checks = []readyCheck{shutdown, checkConfig(), checkDelegates(outputFormats), queue, render}
+
+	code := http.StatusOK
+	for _, check := range status.Checks {
+		if !check.OK {
+			status.Status = "fail"
+			code = http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(status)
+}
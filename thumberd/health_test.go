@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthServer(t *testing.T) {
+	rec := httptest.NewRecorder()
+	healthServer(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("/healthz should be 200, got %d", rec.Code)
+	}
+}
+
+func TestCheckDelegates(t *testing.T) {
+	if c := checkDelegates(map[string]bool{"jpeg": true, "png": true, "webp": true, "heic": true}); !c.OK {
+		t.Errorf("delegates should be ok, got %+v", c)
+	}
+	c := checkDelegates(map[string]bool{"jpeg": true, "png": true, "avif": true})
+	if c.OK || c.Message != "missing webp,heic" {
+		t.Errorf("delegates should be missing webp,heic, got %+v", c)
+	}
+}
+
+func TestCheckRenderWithSaturatedQueue(t *testing.T) {
+	sem := make(chan int, 1)
+	sem <- 1
+	queue, render := checkRender(sem, 50*time.Millisecond)
+	if queue.OK || render.OK {
+		t.Errorf("queue and render should fail, got %+v %+v", queue, render)
+	}
+}
+
+func TestReadyServer(t *testing.T) {
+	defer atomic.StoreInt32(&shuttingDown, 0)
+	h := &Handler{sem: make(chan int, 1)}
+
+	for _, shutdown := range []bool{false, true} {
+		if shutdown {
+			atomic.StoreInt32(&shuttingDown, 1)
+		}
+		rec := httptest.NewRecorder()
+		h.readyServer(rec, httptest.NewRequest("GET", "/readyz", nil))
+
+		var status readyStatus
+		if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+			t.Fatal(err)
+		}
+		checks := make(map[string]bool)
+		for _, c := range status.Checks {
+			checks[c.Name] = c.OK
+		}
+		for _, name := range []string{"shutdown", "config", "delegates", "queue", "render"} {
+			if _, ok := checks[name]; !ok {
+				t.Errorf("/readyz should have the %s check", name)
+			}
+		}
+		if !checks["config"] || !checks["queue"] || !checks["render"] {
+			t.Errorf("/readyz checks should pass: %s", rec.Body.String())
+		}
+		if shutdown && (rec.Code != http.StatusServiceUnavailable || status.Status != "fail") {
+			t.Errorf("/readyz should fail while shutting down, got %d %s", rec.Code, rec.Body.String())
+		}
+	}
+}
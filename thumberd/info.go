@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/smartnews/yoya-thumber/signature"
+	"github.com/smartnews/yoya-thumber/thumbnail"
+)
+
+/*
+ *  /info
+ *  元画像を変換せずに、縦横サイズ、フォーマット、フレーム数などを JSON で返す。
+ *  上流からの取得はサムネールと同じ (SSRF 対策、サイズ制限、署名、preset_only)。
+ *  example: /info?url=example.com%2Fa.jpg
+ */
+
+type imageInfo struct {
+	Url         string `json:"url"`
+	Format      string `json:"format"`
+	ContentType string `json:"content_type"`
+	// EXIF Orientation を適用した後の縦横サイズ
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	Frames      int    `json:"frames"`
+	Orientation int    `json:"orientation"`
+	ColorSpace  string `json:"colorspace"`
+	Alpha       bool   `json:"alpha"`
+	Bytes       int    `json:"bytes"`
+}
+
+func (h *Handler) infoServer(w http.ResponseWriter, r *http.Request) {
+	c := config.Load().(*tomlConfig)
+
+	// 統計とメトリクスはサムネールと同じように記録する
+	startTime := time.Now()
+	defer func() {
+		atomic.AddInt64(&http_stats.total_time_us, int64(time.Since(startTime)/1000))
+	}()
+	atomic.AddInt64(&http_stats.received, 1)
+	atomic.AddInt64(&http_stats.inflight, 1)
+	defer atomic.AddInt64(&http_stats.inflight, -1)
+
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	w = rec
+	defer func() {
+		observeInfoRequest(rec.status, time.Since(startTime))
+	}()
+
+	// "/info?url=example.com%2Fa.jpg" => ["info" "url=example.com%2Fa.jpg"]
+	urlParams := signature.SplitPath(r.RequestURI)
+	// preset_only ではサムネールと同じように、プリセットを使わないリクエストを断る ("info" は除く)
+	if _, err := expandPreset(c, urlParams[1:]); err != nil {
+		glog.Error("Invalid preset: "+err.Error(), http.StatusBadRequest)
+		http.Error(w, "Invalid preset: "+err.Error(), http.StatusBadRequest)
+		atomic.AddInt64(&http_stats.arg_error, 1)
+		return
+	}
+	imageUrl := ""
+	sig := ""
+	for _, arg := range urlParams {
+		tup := strings.SplitN(arg, "=", 2)
+		if len(tup) != 2 {
+			continue
+		}
+		switch tup[0] {
+		case "url":
+			imageUrl, _ = url.QueryUnescape(tup[1])
+		case signature.Name:
+			sig = tup[1]
+		}
+	}
+
+	if len(c.Security.Keys) > 0 && !signature.Verify(signatureKeys(c), urlParams, sig) {
+		glog.Error("Invalid signature", http.StatusForbidden)
+		http.Error(w, "Invalid signature", http.StatusForbidden)
+		atomic.AddInt64(&http_stats.sig_error, 1)
+		return
+	}
+	if imageUrl == "" {
+		glog.Error("url is required", http.StatusBadRequest)
+		http.Error(w, "url is required", http.StatusBadRequest)
+		atomic.AddInt64(&http_stats.arg_error, 1)
+		return
+	}
+
+	result := readImageInfo(r, c, imageUrl, h.sem)
+	if result.status != 0 {
+		for k, v := range result.header {
+			w.Header()[k] = v
+		}
+		http.Error(w, result.message, result.status)
+		atomic.AddInt64(result.stat, 1)
+		return
+	}
+	for k, v := range result.header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(result.body)
+	atomic.AddInt64(&http_stats.ok, 1)
+}
+
+/*
+ *  上流から画像を取得して、ImageMagick の ping でメタデータを読む
+ */
+func readImageInfo(r *http.Request, c *tomlConfig, imageUrl string, sem chan int) *thumbResult {
+	fetchStart := time.Now()
+	maxBytes := maxUpstreamBytes(c)
+
+	srcReader, err, statusCode := myClientImageGet(r.Context(), imageUrl, r.Referer(), c.Http.UserAgent, c.Http.Accept, nil)
+	if err != nil {
+		message := "Upstream failed\tpath:" + r.RequestURI + "\terror:" + err.Error()
+		glog.Errorf("%s\timage_url:%q\tstatus:%d", message, imageUrl, statusCode)
+		return upstreamErrorResult(r, err, statusCode, message)
+	}
+	defer srcReader.Body.Close()
+
+	if srcReader.ContentLength > maxBytes {
+		return limitErrorResult(errUpstreamTooLarge)
+	}
+	imageBlob, format, err := fetchImageWithCorrectFormat(countingReader{srcReader.Body}, maxBytes, maxPixels)
+	if result := limitErrorResult(err); result != nil {
+		return result
+	}
+	if err != nil {
+		message := "Fetch image failed: " + err.Error()
+		glog.Error(message, http.StatusInternalServerError)
+		return errorResult(http.StatusInternalServerError, message, &http_stats.thumb_error)
+	}
+	metrics.phaseDuration["fetch"].observeDuration(time.Since(fetchStart))
+
+	if err := waitWorker(r.Context(), sem, maxQueueWait(c)); err == errQueueTimeout {
+		return queueTimeoutResult()
+	} else if err != nil {
+		return canceledResult(err)
+	}
+	info, err := thumbnail.ImageInfoMagick(imageBlob)
+	<-sem
+	if err != nil {
+		message := "Magick failed: " + err.Error()
+		glog.Error(message, http.StatusInternalServerError)
+		return errorResult(http.StatusInternalServerError, message, &http_stats.thumb_error)
+	}
+
+	contentType := getContentTypeFromFormat()[format]
+	body, err := json.Marshal(imageInfo{
+		Url:         urlCanonical(imageUrl, r.Referer()),
+		Format:      strings.TrimPrefix(contentType, "image/"),
+		ContentType: contentType,
+		Width:       info.Width,
+		Height:      info.Height,
+		Frames:      info.Frames,
+		Orientation: info.Orientation,
+		ColorSpace:  info.ColorSpace,
+		Alpha:       info.Alpha,
+		Bytes:       len(imageBlob),
+	})
+	if err != nil {
+		return errorResult(http.StatusInternalServerError, err.Error(), &http_stats.thumb_error)
+	}
+	header := make(http.Header)
+	setFinalURL(c, header, srcReader)
+	return &thumbResult{header: header, body: body}
+}
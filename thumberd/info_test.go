@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestInfoServerErrors(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/large.jpg":
+			w.Header().Set("Content-Length", strconv.Itoa(defaultMaxUpstreamBytes+1))
+		case "/text":
+			w.Write([]byte("this is not an image"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer origin.Close()
+	host, restore := useTestOrigin(t, origin)
+	defer restore()
+
+	h := &Handler{sem: make(chan int, 1)}
+	cases := []struct {
+		path   string
+		status int
+	}{
+		{"/info", http.StatusBadRequest},
+		{"/info?url=" + host + "%2Fnotfound.jpg", http.StatusNotFound},
+		{"/info?url=" + host + "%2Flarge.jpg", http.StatusRequestEntityTooLarge},
+		{"/info?url=" + host + "%2Ftext", http.StatusInternalServerError},
+		// SSRF の対策はサムネールと同じ
+		{"/info?url=127.0.0.1%2Fa.jpg", http.StatusBadRequest},
+		{"/info?url=10.0.0.1%2Fa.jpg", http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		h.infoServer(rec, httptest.NewRequest("GET", c.path, nil))
+		if rec.Code != c.status {
+			t.Errorf("%s: status = %d, want %d (%s)", c.path, rec.Code, c.status, rec.Body.String())
+		}
+	}
+}
+
+func TestInfoServerSignature(t *testing.T) {
+	oldConfig := config.Load().(*tomlConfig)
+	c := *oldConfig
+	c.Security.Keys = []string{"secret"}
+	config.Store(&c)
+	defer config.Store(oldConfig)
+
+	rec := httptest.NewRecorder()
+	(&Handler{sem: make(chan int, 1)}).infoServer(rec, httptest.NewRequest("GET", "/info?url=example.com%2Fa.jpg", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("unsigned request should be 403, got %d", rec.Code)
+	}
+}
+
+func TestInfoServerPresetOnly(t *testing.T) {
+	oldConfig := config.Load().(*tomlConfig)
+	c := *oldConfig
+	c.Security.PresetOnly = true
+	c.presetArgs = map[string][]string{"thumb": {"w=300"}}
+	config.Store(&c)
+	defer config.Store(oldConfig)
+
+	h := &Handler{sem: make(chan int, 1)}
+	rec := httptest.NewRecorder()
+	h.infoServer(rec, httptest.NewRequest("GET", "/info?url=example.com%2Fa.jpg", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("request without a preset should be 400, got %d", rec.Code)
+	}
+	// プリセットを使えば url 以外の検査に進む
+	rec = httptest.NewRecorder()
+	h.infoServer(rec, httptest.NewRequest("GET", "/info?preset=thumb&url=10.0.0.1%2Fa.jpg", nil))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "Upstream failed") {
+		t.Errorf("preset request should reach the upstream, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestInfoServerMetrics(t *testing.T) {
+	var img bytes.Buffer
+	png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 8, 8)))
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(img.Bytes())
+	}))
+	defer origin.Close()
+	host, restore := useTestOrigin(t, origin)
+	defer restore()
+
+	count := func(h *histogram) uint64 {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return h.count
+	}
+	requests := func(status int) float64 {
+		metrics.requests.mu.Lock()
+		defer metrics.requests.mu.Unlock()
+		return metrics.requests.values[`format="info",crop_mode="none",status="`+strconv.Itoa(status)+`"`]
+	}
+	fetches, bytesBefore := count(metrics.phaseDuration["fetch"]), atomic.LoadInt64(&metrics.upstreamBytes)
+	received, badRequests := atomic.LoadInt64(&http_stats.received), requests(http.StatusBadRequest)
+
+	rec := httptest.NewRecorder()
+	(&Handler{sem: make(chan int, 1)}).infoServer(rec, httptest.NewRequest("GET", "/info?url="+host+"%2Fa.png", nil))
+	if got := count(metrics.phaseDuration["fetch"]); got != fetches+1 {
+		t.Errorf("fetch phase count = %d, want %d", got, fetches+1)
+	}
+	if got := atomic.LoadInt64(&metrics.upstreamBytes) - bytesBefore; got < int64(img.Len()) {
+		t.Errorf("upstream bytes = %d, want at least %d", got, img.Len())
+	}
+	if got := requests(rec.Code); got < 1 {
+		t.Errorf("requests_total for %d = %g", rec.Code, got)
+	}
+
+	rec = httptest.NewRecorder()
+	(&Handler{sem: make(chan int, 1)}).infoServer(rec, httptest.NewRequest("GET", "/info", nil))
+	if got := requests(http.StatusBadRequest); got != badRequests+1 {
+		t.Errorf("requests_total for 400 = %g, want %g", got, badRequests+1)
+	}
+	if got := atomic.LoadInt64(&http_stats.received); got != received+2 {
+		t.Errorf("received = %d, want %d", got, received+2)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+/*
+ *  上流のレスポンスの大きさの制限
+ *  Content-Length と読み込んだバイト数でサイズを制限し、
+ *  ヘッダ部分から縦横サイズを読んで、全体をダウンロードする前に大きすぎる画像を断る。
+ */
+
+const defaultMaxUpstreamBytes = 64 << 20
+
+// 縦横サイズを探すために先に読むバイト数 (JPEG の SOF は EXIF などの後ろにある)
+const sniffBytes = 64 << 10
+
+var errUpstreamTooLarge = errors.New("upstream response too large")
+var errImageTooLarge = errors.New("image dimensions too large")
+
+func maxUpstreamBytes(c *tomlConfig) int64 {
+	if c.Http.MaxUpstreamBytes > 0 {
+		return c.Http.MaxUpstreamBytes
+	}
+	return defaultMaxUpstreamBytes
+}
+
+// limitedReader returns errUpstreamTooLarge instead of reading more than remaining bytes.
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	// 超えたかどうかを知るために 1 バイト余分に読む
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.r.Read(p)
+	if int64(n) > l.remaining {
+		n = int(l.remaining)
+		l.remaining = 0
+		return n, errUpstreamTooLarge
+	}
+	l.remaining -= int64(n)
+	return n, err
+}
+
+/*
+ *  画像のヘッダから縦横サイズを読む。分からない場合は ok = false を返す。
+ */
+func imageDimensions(buf []byte, format int) (width, height int, ok bool) {
+	switch format {
+	case FORMAT_JPEG:
+		return jpegDimensions(buf)
+	case FORMAT_PNG:
+		// IHDR
+		if len(buf) < 24 {
+			return 0, 0, false
+		}
+		return int(binary.BigEndian.Uint32(buf[16:20])), int(binary.BigEndian.Uint32(buf[20:24])), true
+	case FORMAT_GIF:
+		// Logical Screen Descriptor
+		if len(buf) < 10 {
+			return 0, 0, false
+		}
+		return int(binary.LittleEndian.Uint16(buf[6:8])), int(binary.LittleEndian.Uint16(buf[8:10])), true
+	case FORMAT_WEBP:
+		return webpDimensions(buf)
+	case FORMAT_BMP:
+		if len(buf) < 26 {
+			return 0, 0, false
+		}
+		width = int(int32(binary.LittleEndian.Uint32(buf[18:22])))
+		height = int(int32(binary.LittleEndian.Uint32(buf[22:26])))
+		if height < 0 { // top-down
+			height = -height
+		}
+		return width, height, width >= 0
+	}
+	return 0, 0, false
+}
+
+// jpegDimensions reads the SOF segment.
+func jpegDimensions(buf []byte) (width, height int, ok bool) {
+	i := 2
+	for i+4 <= len(buf) {
+		if buf[i] != 0xFF {
+			return 0, 0, false
+		}
+		marker := buf[i+1]
+		switch {
+		case marker == 0xFF: // fill byte
+			i++
+			continue
+		case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD8): // TEM, RSTn, SOI (no length)
+			i += 2
+			continue
+		case marker == 0xDA || marker == 0xD9: // SOS, EOI
+			return 0, 0, false
+		}
+		length := int(binary.BigEndian.Uint16(buf[i+2 : i+4]))
+		if length < 2 {
+			return 0, 0, false
+		}
+		// SOF0〜SOF15 (DHT, JPG, DAC を除く)
+		if marker >= 0xC0 && marker <= 0xCF && marker != 0xC4 && marker != 0xC8 && marker != 0xCC {
+			if i+9 > len(buf) {
+				return 0, 0, false
+			}
+			height = int(binary.BigEndian.Uint16(buf[i+5 : i+7]))
+			width = int(binary.BigEndian.Uint16(buf[i+7 : i+9]))
+			return width, height, true
+		}
+		i += 2 + length
+	}
+	return 0, 0, false
+}
+
+// webpDimensions reads the first chunk (VP8, VP8L or VP8X).
+func webpDimensions(buf []byte) (width, height int, ok bool) {
+	if len(buf) < 30 {
+		return 0, 0, false
+	}
+	switch string(buf[12:16]) {
+	case "VP8 ":
+		// frame tag (3 bytes), start code 9d 01 2a, 14 bit width and height
+		if buf[23] != 0x9D || buf[24] != 0x01 || buf[25] != 0x2A {
+			return 0, 0, false
+		}
+		width = int(binary.LittleEndian.Uint16(buf[26:28]) & 0x3FFF)
+		height = int(binary.LittleEndian.Uint16(buf[28:30]) & 0x3FFF)
+		return width, height, true
+	case "VP8L":
+		// signature 0x2f, 14 bit width-1 and height-1
+		if buf[20] != 0x2F {
+			return 0, 0, false
+		}
+		bits := binary.LittleEndian.Uint32(buf[21:25])
+		return int(bits&0x3FFF) + 1, int((bits>>14)&0x3FFF) + 1, true
+	case "VP8X":
+		// 24 bit canvas width-1 and height-1
+		width = int(uint32(buf[24])|uint32(buf[25])<<8|uint32(buf[26])<<16) + 1
+		height = int(uint32(buf[27])|uint32(buf[28])<<8|uint32(buf[29])<<16) + 1
+		return width, height, true
+	}
+	return 0, 0, false
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func encodedImage(t *testing.T, format string, width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "png":
+		err = png.Encode(&buf, img)
+	case "gif":
+		err = gif.Encode(&buf, img, nil)
+	case "jpeg":
+		err = jpeg.Encode(&buf, img, nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// withAPP1 inserts an APP1 segment (like EXIF) before the other JPEG segments.
+func withAPP1(src []byte, size int) []byte {
+	segment := make([]byte, 4+size)
+	segment[0], segment[1] = 0xFF, 0xE1
+	binary.BigEndian.PutUint16(segment[2:4], uint16(2+size))
+	return append(append(append([]byte{}, src[:2]...), segment...), src[2:]...)
+}
+
+func webpHeader(chunk string, data []byte) []byte {
+	buf := []byte("RIFF\x00\x00\x00\x00WEBP" + chunk + "\x00\x00\x00\x00")
+	return append(buf, data...)
+}
+
+func TestImageDimensions(t *testing.T) {
+	cases := []struct {
+		name          string
+		buf           []byte
+		format        int
+		width, height int
+		ok            bool
+	}{
+		{"png", encodedImage(t, "png", 300, 200), FORMAT_PNG, 300, 200, true},
+		{"gif", encodedImage(t, "gif", 30, 20), FORMAT_GIF, 30, 20, true},
+		{"jpeg", encodedImage(t, "jpeg", 320, 240), FORMAT_JPEG, 320, 240, true},
+		{"jpeg with exif", withAPP1(encodedImage(t, "jpeg", 320, 240), 30000), FORMAT_JPEG, 320, 240, true},
+		{"jpeg truncated", withAPP1(encodedImage(t, "jpeg", 320, 240), 30000)[:1000], FORMAT_JPEG, 0, 0, false},
+		// VP8: frame tag, start code, 14 bit width and height
+		{"webp vp8", webpHeader("VP8 ", []byte{0, 0, 0, 0x9D, 0x01, 0x2A, 0x40, 0x01, 0xF0, 0x00}), FORMAT_WEBP, 320, 240, true},
+		// VP8L: signature, (width-1) | (height-1) << 14
+		{"webp vp8l", webpHeader("VP8L", []byte{0x2F, 0x3F, 0xC1, 0x3B, 0x00, 0, 0, 0, 0, 0}), FORMAT_WEBP, 320, 240, true},
+		// VP8X: flags, reserved, 24 bit width-1 and height-1
+		{"webp vp8x", webpHeader("VP8X", []byte{0, 0, 0, 0, 0x3F, 0x01, 0x00, 0xEF, 0x00, 0x00}), FORMAT_WEBP, 320, 240, true},
+		{"heic", make([]byte, 100), FORMAT_HEIC, 0, 0, false},
+	}
+	for _, c := range cases {
+		width, height, ok := imageDimensions(c.buf, c.format)
+		if ok != c.ok || width != c.width || height != c.height {
+			t.Errorf("%s: imageDimensions = (%d, %d, %v), want (%d, %d, %v)", c.name, width, height, ok, c.width, c.height, c.ok)
+		}
+	}
+}
+
+func TestLimitedReader(t *testing.T) {
+	r := &limitedReader{r: strings.NewReader("0123456789"), remaining: 10}
+	if b, err := ioutil.ReadAll(r); err != nil || string(b) != "0123456789" {
+		t.Errorf("ReadAll = %q, %v", b, err)
+	}
+	r = &limitedReader{r: strings.NewReader("0123456789"), remaining: 9}
+	if _, err := ioutil.ReadAll(r); err != errUpstreamTooLarge {
+		t.Errorf("err = %v, want errUpstreamTooLarge", err)
+	}
+}
+
+func TestFetchImageWithCorrectFormat(t *testing.T) {
+	src := encodedImage(t, "png", 300, 200)
+	if blob, format, err := fetchImageWithCorrectFormat(bytes.NewReader(src), 1<<20, 100000); err != nil || format != FORMAT_PNG || !bytes.Equal(blob, src) {
+		t.Errorf("fetch failed: format %d, err %v", format, err)
+	}
+	if _, _, err := fetchImageWithCorrectFormat(bytes.NewReader(src), int64(len(src)-1), 100000); err != errUpstreamTooLarge {
+		t.Errorf("err = %v, want errUpstreamTooLarge", err)
+	}
+	if _, _, err := fetchImageWithCorrectFormat(bytes.NewReader(src), 1<<20, 300*200-1); err != errImageTooLarge {
+		t.Errorf("err = %v, want errImageTooLarge", err)
+	}
+
+	// 縦横サイズが大きすぎる場合は、ヘッダを読んだ所で断る
+	huge := append(encodedImage(t, "png", 1, 1)[:24], make([]byte, 2<<20)...)
+	binary.BigEndian.PutUint32(huge[16:20], 30000)
+	binary.BigEndian.PutUint32(huge[20:24], 30000)
+	r := &limitedReader{r: bytes.NewReader(huge), remaining: int64(len(huge))}
+	if _, _, err := fetchImageWithCorrectFormat(r, int64(len(huge)), maxPixels); err != errImageTooLarge {
+		t.Errorf("err = %v, want errImageTooLarge", err)
+	}
+	if r.remaining < 1<<20-1024 {
+		t.Errorf("the body should not be read after the header, remaining %d", r.remaining)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ *  Prometheus の text exposition format で /metrics を出力する
+ */
+
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, le := range h.buckets {
+		if v <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) observeDuration(d time.Duration) {
+	h.observe(d.Seconds())
+}
+
+// write writes the samples of the histogram. labels is like `phase="fetch"` or "".
+func (h *histogram) write(w io.Writer, name string, labels string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	for i, le := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %d\n", name, labels, sep, strconv.FormatFloat(le, 'g', -1, 64), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, braces(labels), strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, braces(labels), h.count)
+}
+
+// counterVec is a counter partitioned by labels.
+type counterVec struct {
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec() *counterVec {
+	return &counterVec{values: make(map[string]float64)}
+}
+
+// add adds v to the counter. labels is like `format="jpeg",status="200"`.
+func (c *counterVec) add(labels string, v float64) {
+	c.mu.Lock()
+	c.values[labels] += v
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", name, braces(k), strconv.FormatFloat(c.values[k], 'g', -1, 64))
+	}
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+}
+
+// Processing phases of a thumbnail request.
+var metricsPhases = []string{"fetch", "decode", "process", "encode"}
+
+var metrics = struct {
+	requestDuration  *histogram
+	queueWait        *histogram
+	phaseDuration    map[string]*histogram
+	requests         *counterVec
+	upstreamBytes    int64
+	upstreamRejected *counterVec
+	semQueued        int64
+}{
+	requestDuration: newHistogram(defaultBuckets),
+	queueWait:       newHistogram(defaultBuckets),
+	phaseDuration: map[string]*histogram{
+		"fetch":   newHistogram(defaultBuckets),
+		"decode":  newHistogram(defaultBuckets),
+		"process": newHistogram(defaultBuckets),
+		"encode":  newHistogram(defaultBuckets),
+	},
+	requests:         newCounterVec(),
+	upstreamRejected: newCounterVec(),
+}
+
+// formatLabel returns the output format from the Content-Type of the response.
+func formatLabel(contentType string) string {
+	if strings.HasPrefix(contentType, "image/") {
+		return strings.TrimPrefix(contentType, "image/")
+	}
+	return "none"
+}
+
+// cropModeLabel keeps the label cardinality bounded for invalid crop modes.
+func cropModeLabel(cropMode int) string {
+	switch cropMode {
+	case 0, 1, 2, 3:
+		return strconv.Itoa(cropMode)
+	}
+	return "invalid"
+}
+
+func observeRequest(contentType string, cropMode int, status int, elapsed time.Duration) {
+	metrics.requestDuration.observeDuration(elapsed)
+	metrics.requests.add(fmt.Sprintf("format=%q,crop_mode=%q,status=\"%d\"", formatLabel(contentType), cropModeLabel(cropMode), status), 1)
+}
+
+// observeInfoRequest records a /info request. It has no output image nor crop mode.
+func observeInfoRequest(status int, elapsed time.Duration) {
+	metrics.requestDuration.observeDuration(elapsed)
+	metrics.requests.add(fmt.Sprintf("format=\"info\",crop_mode=\"none\",status=\"%d\"", status), 1)
+}
+
+// statusRecorder remembers the status code written to the response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// countingReader counts the bytes read from the upstream.
+type countingReader struct {
+	io.Reader
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	atomic.AddInt64(&metrics.upstreamBytes, int64(n))
+	return n, err
+}
+
+func metricsServer(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	writeHeader(w, "thumberd_request_duration_seconds", "histogram", "Time spent to serve thumbnail requests.")
+	metrics.requestDuration.write(w, "thumberd_request_duration_seconds", "")
+
+	writeHeader(w, "thumberd_phase_duration_seconds", "histogram", "Time spent in each phase of thumbnail requests.")
+	for _, phase := range metricsPhases {
+		metrics.phaseDuration[phase].write(w, "thumberd_phase_duration_seconds", fmt.Sprintf("phase=%q", phase))
+	}
+
+	writeHeader(w, "thumberd_queue_wait_seconds", "histogram", "Time spent waiting for an ImageMagick worker.")
+	metrics.queueWait.write(w, "thumberd_queue_wait_seconds", "")
+
+	writeHeader(w, "thumberd_requests_total", "counter", "Thumbnail requests by output format, crop mode and HTTP status.")
+	metrics.requests.write(w, "thumberd_requests_total")
+
+	writeHeader(w, "thumberd_requests_in_flight", "gauge", "Thumbnail requests currently being served.")
+	fmt.Fprintf(w, "thumberd_requests_in_flight %d\n", atomic.LoadInt64(&http_stats.inflight))
+
+	writeHeader(w, "thumberd_semaphore_queue_depth", "gauge", "Requests waiting for an ImageMagick worker.")
+	fmt.Fprintf(w, "thumberd_semaphore_queue_depth %d\n", atomic.LoadInt64(&metrics.semQueued))
+
+	writeHeader(w, "thumberd_upstream_bytes_total", "counter", "Bytes read from upstream servers.")
+	fmt.Fprintf(w, "thumberd_upstream_bytes_total %d\n", atomic.LoadInt64(&metrics.upstreamBytes))
+
+	writeHeader(w, "thumberd_upstream_rejected_total", "counter", "Upstream responses rejected by the size (bytes) or dimension (pixels) limits.")
+	metrics.upstreamRejected.write(w, "thumberd_upstream_rejected_total")
+
+	writeHeader(w, "thumberd_cache_hits_total", "counter", "Thumbnail cache hits.")
+	fmt.Fprintf(w, "thumberd_cache_hits_total %d\n", atomic.LoadInt64(&http_stats.cache_hit))
+
+	writeHeader(w, "thumberd_cache_misses_total", "counter", "Thumbnail cache misses.")
+	fmt.Fprintf(w, "thumberd_cache_misses_total %d\n", atomic.LoadInt64(&http_stats.cache_miss))
+
+	writeHeader(w, "thumberd_coalesced_requests_total", "counter", "Requests served by the result of an identical concurrent request.")
+	fmt.Fprintf(w, "thumberd_coalesced_requests_total %d\n", atomic.LoadInt64(&http_stats.coalesced))
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]float64{0.1, 1})
+	h.observe(0.05)
+	h.observe(0.5)
+	h.observe(5)
+
+	var buf bytes.Buffer
+	h.write(&buf, "test_seconds", `phase="fetch"`)
+	expected := `test_seconds_bucket{phase="fetch",le="0.1"} 1
+test_seconds_bucket{phase="fetch",le="1"} 2
+test_seconds_bucket{phase="fetch",le="+Inf"} 3
+test_seconds_sum{phase="fetch"} 5.55
+test_seconds_count{phase="fetch"} 3
+`
+	if buf.String() != expected {
+		t.Errorf("unexpected output:\n%s", buf.String())
+	}
+}
+
+func TestMetricsServer(t *testing.T) {
+	observeRequest("image/webp", 1, http.StatusOK, 0)
+	observeRequest("text/plain; charset=utf-8", 42, http.StatusBadRequest, 0)
+
+	ts := httptest.NewServer(http.HandlerFunc(metricsServer))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Error("unexpected")
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Error("Status code should be 200")
+		return
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	for _, line := range []string{
+		`thumberd_requests_total{format="webp",crop_mode="1",status="200"} 1`,
+		`thumberd_requests_total{format="none",crop_mode="invalid",status="400"} 1`,
+		`thumberd_phase_duration_seconds_count{phase="decode"}`,
+		`thumberd_requests_in_flight `,
+		`thumberd_semaphore_queue_depth `,
+		`thumberd_upstream_bytes_total `,
+	} {
+		if !strings.Contains(string(body), line) {
+			t.Errorf("metrics should contain %q", line)
+		}
+	}
+}
+
+func TestPhaseDurationOnlyOnSuccess(t *testing.T) {
+	// ヘッダだけの PNG は取得できるが、デコードに失敗する
+	var img bytes.Buffer
+	png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 8, 8)))
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(img.Bytes()[:40])
+	}))
+	defer origin.Close()
+	host, restore := useTestOrigin(t, origin)
+	defer restore()
+	ts := httptest.NewServer(newTestHandler())
+	defer ts.Close()
+
+	count := func(phase string) uint64 {
+		h := metrics.phaseDuration[phase]
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return h.count
+	}
+	before := map[string]uint64{}
+	for _, phase := range []string{"decode", "process", "encode"} {
+		before[phase] = count(phase)
+	}
+	res, err := http.Get(ts.URL + "/w=10,url=" + host + "/broken.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("status = %d", res.StatusCode)
+	}
+	for phase, n := range before {
+		if got := count(phase); got != n {
+			t.Errorf("%s: %d samples after a failed render, want %d", phase, got, n)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+/*
+ *  画像の取得元 (Origin)
+ *  URL のスキームで取得元を選ぶ。http, https, data は組み込み。
+ *  [origin.<name>] を書くと <name>://<path> でその取得元を使える。
+ *    type = "file" : root 以下のファイル (root の外は読まない)
+ *    type = "s3"   : S3 互換のバケット (SigV4 で署名する)
+ */
+
+// Origin fetches a source image. Missing or forbidden images are returned as responses with a 4xx status.
+type Origin interface {
+	// header has Referer, User-Agent, Accept and the conditional request headers.
+	// ctx is the context of the client request.
+	Fetch(ctx context.Context, u *url.URL, header http.Header) (*http.Response, error)
+}
+
+type originConfig struct {
+	Type string // "file" or "s3"
+	// file
+	Root string
+	// s3
+	Endpoint     string // default "https://s3.<region>.amazonaws.com"
+	Region       string // default "us-east-1"
+	Bucket       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	PathStyle    bool // <endpoint>/<bucket>/<key> instead of <bucket>.<endpoint host>/<key>
+}
+
+// 組み込みの取得元。[origin.<name>] では使えない。
+var builtinOrigins = map[string]Origin{
+	"http":  httpOrigin{},
+	"https": httpOrigin{},
+	"data":  dataOrigin{},
+}
+
+func newOrigin(oc originConfig) (Origin, error) {
+	switch oc.Type {
+	case "file":
+		return newFileOrigin(oc.Root)
+	case "s3":
+		return newS3Origin(oc)
+	}
+	return nil, fmt.Errorf("unknown type %q", oc.Type)
+}
+
+func loadOrigins(c *tomlConfig) error {
+	c.origins = make(map[string]Origin, len(c.Origin))
+	for name, oc := range c.Origin {
+		if _, ok := builtinOrigins[name]; ok {
+			return fmt.Errorf("origin.%s: %s is reserved", name, name)
+		}
+		if u, err := url.Parse(name + "://"); err != nil || u.Scheme != name {
+			return fmt.Errorf("origin.%s: the name must be a valid URL scheme", name)
+		}
+		origin, err := newOrigin(oc)
+		if err != nil {
+			return fmt.Errorf("origin.%s: %s", name, err)
+		}
+		c.origins[name] = origin
+	}
+	return nil
+}
+
+func getOrigin(c *tomlConfig, scheme string) (Origin, bool) {
+	if origin, ok := builtinOrigins[scheme]; ok {
+		return origin, true
+	}
+	origin, ok := c.origins[scheme]
+	return origin, ok
+}
+
+func isOriginScheme(scheme string) bool {
+	c, _ := config.Load().(*tomlConfig)
+	if c == nil {
+		_, ok := builtinOrigins[scheme]
+		return ok
+	}
+	_, ok := getOrigin(c, scheme)
+	return ok
+}
+
+// originPath returns "<host><path>" of name://host/path without the leading "/".
+func originPath(u *url.URL) string {
+	return strings.TrimLeft(u.Host+u.Path, "/")
+}
+
+// originResponse makes a response for origins other than HTTP.
+func originResponse(status int, header http.Header, body io.ReadCloser, length int64) *http.Response {
+	if header == nil {
+		header = make(http.Header)
+	}
+	if body == nil {
+		body = http.NoBody
+	}
+	return &http.Response{
+		Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          body,
+		ContentLength: length,
+	}
+}
+
+/*
+ *  Last-Modified と ETag で条件付きリクエストを判定する。(http 以外の取得元用)
+ */
+func originNotModified(header http.Header, etag string, modified time.Time) bool {
+	if ifNoneMatch := header.Get("If-None-Match"); ifNoneMatch != "" {
+		for _, tag := range parseETags(ifNoneMatch) {
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	return !modified.Truncate(time.Second).After(since)
+}
+
+/*
+ *  HTTP(S) の上流 (従来の取得方法)
+ */
+type httpOrigin struct{}
+
+func (httpOrigin) Fetch(ctx context.Context, u *url.URL, header http.Header) (*http.Response, error) {
+	if err := checkUpstreamURL(u); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		glog.Error("Failed to create NewRequest.")
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	client := getHttpClient()
+	policy := getUpstreamPolicy(config.Load().(*tomlConfig), u.Host)
+	return fetchWithRetry(ctx, u.Host, policy, func() (*http.Response, error) {
+		return client.Do(req)
+	})
+}
+
+/*
+ *  data: URL (RFC 2397)
+ *  data:image/png;base64,iVBORw0KGgo...
+ */
+type dataOrigin struct{}
+
+func (dataOrigin) Fetch(ctx context.Context, u *url.URL, header http.Header) (*http.Response, error) {
+	words := strings.SplitN(u.Opaque, ",", 2)
+	if len(words) != 2 {
+		return nil, errors.New("invalid data URL")
+	}
+	mediaType, isBase64 := words[0], false
+	if strings.HasSuffix(mediaType, ";base64") {
+		mediaType, isBase64 = strings.TrimSuffix(mediaType, ";base64"), true
+	}
+	data, err := url.PathUnescape(words[1])
+	if err != nil {
+		return nil, errors.New("invalid data URL: " + err.Error())
+	}
+	body := []byte(data)
+	if isBase64 {
+		if body, err = base64.StdEncoding.DecodeString(data); err != nil {
+			return nil, errors.New("invalid data URL: " + err.Error())
+		}
+	}
+	h := make(http.Header)
+	if mediaType != "" {
+		h.Set("Content-Type", mediaType)
+	}
+	return originResponse(http.StatusOK, h, ioutil.NopCloser(bytes.NewReader(body)), int64(len(body))), nil
+}
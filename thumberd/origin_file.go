@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+/*
+ *  ローカルのディレクトリ
+ *  <name>://a/b.jpg は root/a/b.jpg を読む。
+ *  ".." やシンボリックリンクで root の外に出るファイルは 403 にする。
+ */
+type fileOrigin struct {
+	root string // 絶対パス、シンボリックリンク解決済み
+}
+
+func newFileOrigin(root string) (*fileOrigin, error) {
+	if root == "" {
+		return nil, errors.New("root is required")
+	}
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	resolved, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := os.Stat(resolved); err != nil {
+		return nil, err
+	} else if !fi.IsDir() {
+		return nil, errors.New(root + " is not a directory")
+	}
+	return &fileOrigin{root: resolved}, nil
+}
+
+func (o *fileOrigin) contains(name string) bool {
+	if name == o.root {
+		return true
+	}
+	return strings.HasPrefix(name, strings.TrimSuffix(o.root, string(filepath.Separator))+string(filepath.Separator))
+}
+
+/*
+ *  URL のパスを root 以下のファイル名にする。
+ *  "/" を付けてから Clean するので ".." で root より上には行かない。シンボリックリンクは解決してから root の中か確かめる。
+ */
+func (o *fileOrigin) resolve(name string) (string, int) {
+	if strings.IndexByte(name, 0) >= 0 {
+		return "", http.StatusBadRequest
+	}
+	joined := filepath.Join(o.root, filepath.FromSlash(path.Clean("/"+name)))
+	resolved, err := filepath.EvalSymlinks(joined)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", http.StatusNotFound
+		}
+		return "", http.StatusForbidden
+	}
+	if !o.contains(resolved) {
+		return "", http.StatusForbidden
+	}
+	return resolved, http.StatusOK
+}
+
+func (o *fileOrigin) Fetch(ctx context.Context, u *url.URL, header http.Header) (*http.Response, error) {
+	name, status := o.resolve(originPath(u))
+	if status != http.StatusOK {
+		return originResponse(status, nil, nil, 0), nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return originResponse(http.StatusNotFound, nil, nil, 0), nil
+		}
+		return originResponse(http.StatusForbidden, nil, nil, 0), nil
+	}
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		f.Close()
+		return originResponse(http.StatusNotFound, nil, nil, 0), nil
+	}
+
+	etag := fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size())
+	h := make(http.Header)
+	h.Set("ETag", etag)
+	h.Set("Last-Modified", fi.ModTime().UTC().Format(http.TimeFormat))
+	if originNotModified(header, etag, fi.ModTime()) {
+		f.Close()
+		return originResponse(http.StatusNotModified, h, nil, 0), nil
+	}
+	return originResponse(http.StatusOK, h, f, fi.Size()), nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileOrigin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thumberd-origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	os.MkdirAll(filepath.Join(root, "a"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "a", "b.jpg"), []byte("image"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "secret.jpg"), []byte("secret"), 0644)
+	os.Symlink(filepath.Join(dir, "secret.jpg"), filepath.Join(root, "out.jpg"))
+	os.Symlink(filepath.Join(root, "a", "b.jpg"), filepath.Join(root, "in.jpg"))
+	defer useOrigins(t, map[string]originConfig{"local": {Type: "file", Root: root}})()
+
+	for url, want := range map[string]int{
+		"local://a/b.jpg":              http.StatusOK,
+		"local:///a/b.jpg":             http.StatusOK,
+		"local://a/%62.jpg":            http.StatusOK,
+		"local://in.jpg":               http.StatusOK,
+		"local://a/../a/b.jpg":         http.StatusOK,
+		"local://a/../../secret.jpg":   http.StatusNotFound, // root/secret.jpg
+		"local://a/%2e%2e/../../x.jpg": http.StatusNotFound,
+		"local://out.jpg":              http.StatusForbidden,
+		"local://a":                    http.StatusNotFound,
+		"local://none.jpg":             http.StatusNotFound,
+	} {
+		res, err, status := myClientImageGet(context.Background(), url, "", "", "", nil)
+		if status != want {
+			t.Errorf("%s: status = %d, want %d (%v)", url, status, want, err)
+			continue
+		}
+		if status == http.StatusOK {
+			body, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			if string(body) != "image" || res.ContentLength != 5 {
+				t.Errorf("%s: body = %q, length = %d", url, body, res.ContentLength)
+			}
+		}
+	}
+}
+
+func TestFileOriginConditions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thumberd-origin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "a.jpg"), []byte("image"), 0644)
+	defer useOrigins(t, map[string]originConfig{"local": {Type: "file", Root: dir}})()
+
+	res, _, status := myClientImageGet(context.Background(), "local://a.jpg", "", "", "", nil)
+	if status != http.StatusOK {
+		t.Fatalf("status = %d", status)
+	}
+	res.Body.Close()
+	etag, lastModified := res.Header.Get("ETag"), res.Header.Get("Last-Modified")
+	if etag == "" || lastModified == "" {
+		t.Fatalf("ETag = %q, Last-Modified = %q", etag, lastModified)
+	}
+
+	for _, conditions := range []http.Header{
+		{"If-None-Match": {etag}},
+		{"If-Modified-Since": {lastModified}},
+	} {
+		if _, _, status := myClientImageGet(context.Background(), "local://a.jpg", "", "", "", conditions); status != http.StatusNotModified {
+			t.Errorf("%v: status = %d, want 304", conditions, status)
+		}
+	}
+	res, _, status = myClientImageGet(context.Background(), "local://a.jpg", "", "", "", http.Header{"If-None-Match": {`"other"`}})
+	if status != http.StatusOK {
+		t.Errorf("status = %d, want 200", status)
+	} else {
+		res.Body.Close()
+	}
+}
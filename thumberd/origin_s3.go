@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+ *  S3 互換のバケット
+ *  <name>://dir/key.jpg はバケットの "dir/key.jpg" を取得する。リクエストは SigV4 で署名する。
+ *  エンドポイントは設定で決まるので、上流の接続先の検査 (SSRF 対策) はしない。
+ */
+type s3Origin struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	cred      s3Credentials
+	pathStyle bool
+	now       func() time.Time
+}
+
+type s3Credentials struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// originTransport is used by the origins whose address is set in the config.
+var originTransport = newOriginTransport()
+
+func newOriginTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	return t
+}
+
+func newS3Origin(oc originConfig) (*s3Origin, error) {
+	if oc.Bucket == "" {
+		return nil, errors.New("bucket is required")
+	}
+	region := oc.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	endpoint := oc.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("invalid endpoint " + endpoint)
+	}
+	return &s3Origin{
+		endpoint:  u,
+		region:    region,
+		bucket:    oc.Bucket,
+		cred:      s3Credentials{oc.AccessKey, oc.SecretKey, oc.SessionToken},
+		pathStyle: oc.PathStyle,
+		now:       time.Now,
+	}, nil
+}
+
+func (o *s3Origin) objectURL(key string) *url.URL {
+	u := *o.endpoint
+	prefix := strings.TrimSuffix(u.Path, "/")
+	if o.pathStyle {
+		prefix += "/" + o.bucket
+	} else {
+		u.Host = o.bucket + "." + u.Host
+	}
+	u.Path = prefix + "/" + key
+	u.RawPath = s3Escape(u.Path)
+	return &u
+}
+
+func (o *s3Origin) Fetch(ctx context.Context, u *url.URL, header http.Header) (*http.Response, error) {
+	key := originPath(u)
+	if key == "" {
+		return originResponse(http.StatusNotFound, nil, nil, 0), nil
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", o.objectURL(key).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if o.cred.accessKey != "" {
+		signV4(req, emptyPayloadHash, o.cred, o.region, "s3", o.now())
+	}
+	// 署名の後に追加したヘッダは署名に含まれない
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	client := http.Client{
+		Timeout:   time.Duration(*timeout) * time.Second,
+		Transport: originTransport,
+	}
+	policy := getUpstreamPolicy(config.Load().(*tomlConfig), req.URL.Host)
+	return fetchWithRetry(ctx, req.URL.Host, policy, func() (*http.Response, error) {
+		return client.Do(req)
+	})
+}
+
+// s3Escape is the URI encoding of SigV4. "/" is not escaped.
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			b.WriteByte(c)
+		} else {
+			b.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+/*
+ *  AWS Signature Version 4 で署名する。(https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html)
+ *  host と、この時点で req にあるヘッダを署名する。クエリ文字列は使わない。
+ */
+func signV4(req *http.Request, payloadHash string, cred s3Credentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if cred.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", cred.sessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for k, v := range req.Header {
+		values := make([]string, len(v))
+		for i := range v {
+			values[i] = strings.Join(strings.Fields(v[i]), " ")
+		}
+		headers[strings.ToLower(k)] = strings.Join(values, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path),
+		"", // query string
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex(canonicalRequest)
+
+	key := hmacSHA256([]byte("AWS4"+cred.secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+cred.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// useOrigins adds [origin.<name>] to the current config and returns a function to restore it.
+func useOrigins(t *testing.T, origins map[string]originConfig) func() {
+	old := config.Load().(*tomlConfig)
+	c := *old
+	c.Origin = origins
+	if err := loadOrigins(&c); err != nil {
+		t.Fatal(err)
+	}
+	config.Store(&c)
+	return func() { config.Store(old) }
+}
+
+func TestLoadOrigins(t *testing.T) {
+	for name, oc := range map[string]originConfig{
+		"http":  {Type: "file", Root: "."},
+		"a_b":   {Type: "file", Root: "."},
+		"local": {Type: "ftp"},
+		"store": {Type: "s3"},
+	} {
+		c := &tomlConfig{Origin: map[string]originConfig{name: oc}}
+		if err := loadOrigins(c); err == nil {
+			t.Errorf("origin.%s %+v should be an error", name, oc)
+		}
+	}
+}
+
+func TestUrlCanonicalWithOrigin(t *testing.T) {
+	defer useOrigins(t, map[string]originConfig{"local": {Type: "file", Root: "."}})()
+	for url, want := range map[string]string{
+		"example.org/a.jpg":       "http://example.org/a.jpg",
+		"https:/example.org/a":    "https://example.org/a",
+		"local:/a/b.jpg":          "local://a/b.jpg",
+		"local:///a/b.jpg":        "local://a/b.jpg",
+		"other://a/b.jpg":         "http://other://a/b.jpg",
+		"data:image/gif;base64,R": "data:image/gif;base64,R",
+	} {
+		if got := urlCanonical(url, ""); got != want {
+			t.Errorf("urlCanonical(%q) = %q, want %q", url, got, want)
+		}
+	}
+}
+
+func TestDataOrigin(t *testing.T) {
+	for raw, want := range map[string]string{
+		"data:image/svg+xml,%3Csvg%2F%3E": "<svg/>",
+		"data:image/png;base64,iVBORw==":  "\x89PNG",
+	} {
+		u, _ := url.Parse(raw)
+		res, err := dataOrigin{}.Fetch(context.Background(), u, nil)
+		if err != nil {
+			t.Errorf("%s: %v", raw, err)
+			continue
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		if res.StatusCode != http.StatusOK || string(body) != want || res.ContentLength != int64(len(want)) {
+			t.Errorf("%s: got %d %q", raw, res.StatusCode, body)
+		}
+	}
+	res, _ := dataOrigin{}.Fetch(context.Background(), &url.URL{Scheme: "data", Opaque: "image/png;base64,iVBORw=="}, nil)
+	if ct := res.Header.Get("Content-Type"); ct != "image/png" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	for _, raw := range []string{"data:image/png", "data:;base64,!!"} {
+		u, _ := url.Parse(raw)
+		if _, err := (dataOrigin{}).Fetch(context.Background(), u, nil); err == nil {
+			t.Errorf("%s should be an error", raw)
+		}
+	}
+}
+
+func TestMyClientImageGetWithUnknownOrigin(t *testing.T) {
+	if _, err, status := myClientImageGet(context.Background(), "ftp://example.org/a.jpg", "", "", "", nil); err == nil || status != http.StatusBadRequest {
+		t.Errorf("ftp: status = %d, err = %v", status, err)
+	}
+}
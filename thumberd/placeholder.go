@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/smartnews/yoya-thumber/thumbnail"
+)
+
+/*
+ *  プレースホルダ (fo=json)
+ *  サムネールの代わりに、最も多い色、平均色、BlurHash と小さな WebP (LQIP, lqip=1) を JSON で返す。
+ *  サムネールと同じパラメータ (クロップ、sc など) で小さく縮小した画像から計算する。
+ */
+
+const placeholderFormat = "json"
+
+const (
+	defaultBlurHashX = 4
+	defaultBlurHashY = 3
+	defaultLQIPSize  = 16
+)
+
+var errBlurHashComponents = errors.New("bhx and bhy must be between 1 and 9")
+
+type placeholderResponse struct {
+	DominantColor string `json:"dominant_color"`
+	AverageColor  string `json:"average_color"`
+	BlurHash      string `json:"blurhash"`
+	LQIP          string `json:"lqip,omitempty"` // data URI
+}
+
+/*
+ *  BlurHash の成分数と LQIP の大きさを設定する。リクエストで指定されなければ [placeholder] の値を使う。
+ */
+func setPlaceholderParams(c *tomlConfig, params *thumbnail.ThumbnailParameters, lqip bool) error {
+	if params.BlurHashX == 0 {
+		params.BlurHashX = c.Placeholder.BlurhashX
+	}
+	if params.BlurHashX == 0 {
+		params.BlurHashX = defaultBlurHashX
+	}
+	if params.BlurHashY == 0 {
+		params.BlurHashY = c.Placeholder.BlurhashY
+	}
+	if params.BlurHashY == 0 {
+		params.BlurHashY = defaultBlurHashY
+	}
+	if params.BlurHashX < 1 || params.BlurHashX > 9 || params.BlurHashY < 1 || params.BlurHashY > 9 {
+		return errBlurHashComponents
+	}
+	params.LQIPSize = 0
+	if lqip {
+		params.LQIPSize = c.Placeholder.LqipSize
+		if params.LQIPSize <= 0 {
+			params.LQIPSize = defaultLQIPSize
+		}
+	}
+	return nil
+}
+
+func makePlaceholder(blob []byte, dst http.ResponseWriter, params thumbnail.ThumbnailParameters) error {
+	placeholder, err := thumbnail.MakePlaceholderMagick(blob, params)
+	if err != nil {
+		return err
+	}
+	res := placeholderResponse{
+		DominantColor: placeholder.DominantColor,
+		AverageColor:  placeholder.AverageColor,
+		BlurHash:      placeholder.BlurHash,
+	}
+	if placeholder.LQIP != nil {
+		res.LQIP = "data:image/webp;base64," + base64.StdEncoding.EncodeToString(placeholder.LQIP)
+	}
+	body, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	if params.HttpAvoidChunk {
+		dst.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	dst.Write(body)
+	return nil
+}
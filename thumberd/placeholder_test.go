@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/smartnews/yoya-thumber/thumbnail"
+)
+
+func TestSetPlaceholderParams(t *testing.T) {
+	c := &tomlConfig{}
+	var params thumbnail.ThumbnailParameters
+	if err := setPlaceholderParams(c, &params, false); err != nil {
+		t.Fatal(err)
+	}
+	if params.BlurHashX != defaultBlurHashX || params.BlurHashY != defaultBlurHashY || params.LQIPSize != 0 {
+		t.Errorf("unexpected defaults %d %d %d", params.BlurHashX, params.BlurHashY, params.LQIPSize)
+	}
+
+	c.Placeholder.BlurhashX = 5
+	c.Placeholder.LqipSize = 24
+	params = thumbnail.ThumbnailParameters{BlurHashY: 2}
+	if err := setPlaceholderParams(c, &params, true); err != nil {
+		t.Fatal(err)
+	}
+	if params.BlurHashX != 5 || params.BlurHashY != 2 || params.LQIPSize != 24 {
+		t.Errorf("unexpected params %d %d %d", params.BlurHashX, params.BlurHashY, params.LQIPSize)
+	}
+
+	params = thumbnail.ThumbnailParameters{BlurHashX: 10}
+	if err := setPlaceholderParams(c, &params, false); err != errBlurHashComponents {
+		t.Errorf("err = %v, want errBlurHashComponents", err)
+	}
+	params = thumbnail.ThumbnailParameters{BlurHashY: -1}
+	if err := setPlaceholderParams(c, &params, false); err != errBlurHashComponents {
+		t.Errorf("err = %v, want errBlurHashComponents", err)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/smartnews/yoya-thumber/signature"
+)
+
+/*
+ *  プリセット
+ *  [preset.<name>] に書いたパラメータを preset=<name> または /p/<name>/ で使う。
+ *  プリセットのパラメータはリクエストのパラメータの前に展開するので、
+ *  [image] preset_override が true なら、明示したパラメータで上書きできる。
+ *  [security] preset_only が true ならプリセットを使わないリクエストと、url と sig 以外の明示したパラメータを断る。
+ */
+
+var errUnknownPreset = errors.New("unknown preset")
+var errPresetOverride = errors.New("parameter set by the preset can't be overridden")
+var errPresetRequired = errors.New("only preset requests are allowed")
+
+// リクエストでしか指定できないパラメータ
+var presetReserved = map[string]bool{"url": true, signature.Name: true, signature.PresetParam: true}
+
+/*
+ *  [preset.<name>] の値を name=value の組に変換する。値は URL と同じように書く。
+ *  example: { w = 300, cm = 1, fo = "webp" } => ["cm=1" "fo=webp" "w=300"]
+ */
+func presetArgs(name string, preset map[string]interface{}) ([]string, error) {
+	args := make([]string, 0, len(preset))
+	for k, v := range preset {
+		if presetReserved[k] {
+			return nil, fmt.Errorf("preset.%s: %s can't be set in a preset", name, k)
+		}
+		switch v := v.(type) {
+		case string, int64, float64:
+			args = append(args, fmt.Sprintf("%s=%v", k, v))
+		case bool:
+			if v {
+				args = append(args, k+"=1")
+			} else {
+				args = append(args, k+"=0")
+			}
+		default:
+			return nil, fmt.Errorf("preset.%s: invalid value for %s", name, k)
+		}
+	}
+	sort.Strings(args)
+	return args, nil
+}
+
+func loadPresets(c *tomlConfig) error {
+	c.presetArgs = make(map[string][]string, len(c.Preset))
+	for name, preset := range c.Preset {
+		args, err := presetArgs(name, preset)
+		if err != nil {
+			return err
+		}
+		c.presetArgs[name] = args
+	}
+	return nil
+}
+
+func argName(arg string) string {
+	return strings.SplitN(arg, "=", 2)[0]
+}
+
+/*
+ *  リクエストのパラメータにプリセットのパラメータを展開する。
+ *  ["preset=thumb" "url=a.jpg" "q=90"] => ["q=80" "w=300" "preset=thumb" "url=a.jpg" "q=90"]
+ */
+func expandPreset(c *tomlConfig, urlParams []string) ([]string, error) {
+	name := ""
+	for _, arg := range urlParams {
+		if argName(arg) == signature.PresetParam {
+			name = strings.TrimPrefix(arg, signature.PresetParam+"=")
+		}
+	}
+	if name == "" {
+		if c.Security.PresetOnly {
+			return nil, errPresetRequired
+		}
+		return urlParams, nil
+	}
+	args, ok := c.presetArgs[name]
+	if !ok {
+		return nil, errUnknownPreset
+	}
+
+	if c.Security.PresetOnly || !c.Image.PresetOverride {
+		inPreset := make(map[string]bool, len(args))
+		for _, arg := range args {
+			inPreset[argName(arg)] = true
+		}
+		for _, arg := range urlParams {
+			name := argName(arg)
+			if arg == "" || presetReserved[name] {
+				continue
+			}
+			if c.Security.PresetOnly {
+				return nil, errPresetRequired
+			}
+			if inPreset[name] {
+				return nil, errPresetOverride
+			}
+		}
+	}
+	return append(append([]string{}, args...), urlParams...), nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func presetConfig(t *testing.T) *tomlConfig {
+	c := &tomlConfig{Preset: map[string]map[string]interface{}{
+		"thumb": {"w": int64(300), "h": int64(200), "cm": int64(1), "fo": "webp", "u": true},
+	}}
+	if err := loadPresets(c); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestPresetArgs(t *testing.T) {
+	c := presetConfig(t)
+	want := []string{"cm=1", "fo=webp", "h=200", "u=1", "w=300"}
+	if !reflect.DeepEqual(c.presetArgs["thumb"], want) {
+		t.Errorf("presetArgs = %q, want %q", c.presetArgs["thumb"], want)
+	}
+
+	for _, preset := range []map[string]interface{}{
+		{"url": "example.com/a.jpg"},
+		{"sig": "x"},
+		{"w": []interface{}{int64(1)}},
+	} {
+		if _, err := presetArgs("bad", preset); err == nil {
+			t.Errorf("%v should be an error", preset)
+		}
+	}
+}
+
+func TestExpandPreset(t *testing.T) {
+	c := presetConfig(t)
+	args, err := expandPreset(c, []string{"url=a.jpg", "preset=thumb"})
+	want := []string{"cm=1", "fo=webp", "h=200", "u=1", "w=300", "url=a.jpg", "preset=thumb"}
+	if err != nil || !reflect.DeepEqual(args, want) {
+		t.Errorf("expandPreset = %q, %v", args, err)
+	}
+
+	if _, err := expandPreset(c, []string{"url=a.jpg", "preset=none"}); err != errUnknownPreset {
+		t.Errorf("err = %v, want errUnknownPreset", err)
+	}
+	// プリセットに無いパラメータは追加できる
+	if _, err := expandPreset(c, []string{"url=a.jpg", "preset=thumb", "q=90"}); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, err := expandPreset(c, []string{"url=a.jpg", "preset=thumb", "w=100"}); err != errPresetOverride {
+		t.Errorf("err = %v, want errPresetOverride", err)
+	}
+	c.Image.PresetOverride = true
+	args, err = expandPreset(c, []string{"url=a.jpg", "preset=thumb", "w=100"})
+	if err != nil || args[len(args)-1] != "w=100" {
+		t.Errorf("explicit parameters should come after the preset, got %q, %v", args, err)
+	}
+
+	// preset_only では url と sig しか指定できない
+	c.Security.PresetOnly = true
+	if _, err := expandPreset(c, []string{"url=a.jpg", "w=100"}); err != errPresetRequired {
+		t.Errorf("err = %v, want errPresetRequired", err)
+	}
+	if _, err := expandPreset(c, []string{"url=a.jpg", "preset=thumb", "q=90"}); err != errPresetRequired {
+		t.Errorf("err = %v, want errPresetRequired", err)
+	}
+	if _, err := expandPreset(c, []string{"url=a.jpg", "preset=thumb", "sig=x"}); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
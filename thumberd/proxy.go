@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	netproxy "golang.org/x/net/proxy"
+)
+
+/*
+ *  上流へのプロキシ
+ *  [proxy] url を全体のプロキシ、[domain."host"] Proxy をホスト毎のプロキシにする。("direct" なら直接接続)
+ *  [proxy] no_proxy のホストは直接接続する。
+ *  プロキシ経由の Transport はプロキシにしか接続しないので、接続先の検査 (SSRF 対策) をせずにプロキシに接続する。
+ *  その代わり、上流のホストをこちらで名前解決して検査し、検査した IP アドレスへの接続をプロキシに頼む。
+ *  (ホスト名のまま頼むと、プロキシが名前解決した時に別のアドレスになり得る: DNS rebinding)
+ *  HTTP プロキシには CONNECT、SOCKS5 プロキシには CONNECT コマンドで IP アドレスを指定して、
+ *  その上で TLS (SNI と証明書の検証) と HTTP (Host ヘッダ) は元のホスト名で行う。名前解決できないホストは断る。
+ */
+
+// [domain."host"] Proxy でプロキシを使わない
+const proxyDirect = "direct"
+
+// proxyDialer connects to the proxies. They are set in the config, so the address policy is not checked.
+var proxyDialer = &net.Dialer{
+	Timeout:   30 * time.Second,
+	KeepAlive: 30 * time.Second,
+}
+
+func parseProxyURL(s string) (*url.URL, error) {
+	if s == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, errors.New("unsupported proxy scheme: " + u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, errors.New("invalid proxy url: " + s)
+	}
+	return u, nil
+}
+
+/*
+ *  no_proxy のパターン
+ *  "*" は全て、"example.com" は example.com とそのサブドメイン、".example.com" はサブドメインだけ、
+ *  "10.0.0.0/8" のような CIDR はその範囲の IP アドレスに一致する。
+ */
+type noProxyList struct {
+	all      bool
+	domains  []string // "example.com" => ".example.com" と "example.com" の両方
+	suffixes []string
+	networks []*net.IPNet
+}
+
+func parseNoProxy(patterns []string) (*noProxyList, error) {
+	var l noProxyList
+	for _, p := range patterns {
+		p = strings.ToLower(strings.TrimSpace(p))
+		switch {
+		case p == "":
+		case p == "*":
+			l.all = true
+		case strings.Contains(p, "/"):
+			_, network, err := net.ParseCIDR(p)
+			if err != nil {
+				return nil, err
+			}
+			l.networks = append(l.networks, network)
+		case strings.HasPrefix(p, "."):
+			l.suffixes = append(l.suffixes, p)
+		default:
+			l.domains = append(l.domains, p)
+		}
+	}
+	return &l, nil
+}
+
+// match reports whether host (with or without the port) is connected to directly.
+func (l *noProxyList) match(host string) bool {
+	if l == nil {
+		return false
+	}
+	if l.all {
+		return true
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	if ip := net.ParseIP(host); ip != nil {
+		return containsIP(l.networks, ip) || l.matchDomain(host)
+	}
+	return l.matchDomain(host)
+}
+
+func (l *noProxyList) matchDomain(host string) bool {
+	for _, d := range l.domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	for _, s := range l.suffixes {
+		if strings.HasSuffix(host, s) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ *  プロキシに送る前に上流のホスト ("host:port") を検査して、接続する "ip:port" を返す。
+ *  IP アドレスはそのまま、ホスト名は名前解決した全てのアドレスを [security] の設定で検査する。
+ */
+func resolveProxiedTarget(ctx context.Context, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return addr, getAddressPolicy().checkAddress(addr)
+	}
+	resolver := upstreamDialer.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	if len(addrs) == 0 {
+		return "", errors.New("no addresses for " + host)
+	}
+	for _, addr := range addrs {
+		if !getAddressPolicy().isAllowed(addr.IP) {
+			return "", fmt.Errorf("%w: %s", errAddressProhibited, addr.IP)
+		}
+	}
+	return net.JoinHostPort(addrs[0].IP.String(), port), nil
+}
+
+// proxyTransport is an http.Transport which connects to the upstreams through proxy.
+type proxyTransport struct {
+	*http.Transport
+	proxy *url.URL
+}
+
+func newProxyTransport(proxy *url.URL) *proxyTransport {
+	t := &proxyTransport{Transport: newDefaultTransport(), proxy: proxy}
+	// Transport.Proxy を使うとホスト名のままプロキシに送るので、接続は DialContext で作る
+	t.DialContext = t.dial
+	return t
+}
+
+// dial connects to addr ("host:port" of the upstream) through the proxy, at the address checked by the policy.
+func (t *proxyTransport) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	target, err := resolveProxiedTarget(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	if t.proxy.Scheme == "socks5" {
+		var auth *netproxy.Auth
+		if u := t.proxy.User; u != nil {
+			password, _ := u.Password()
+			auth = &netproxy.Auth{User: u.Username(), Password: password}
+		}
+		dialer, err := netproxy.SOCKS5("tcp", proxyAddr(t.proxy), auth, proxyDialer)
+		if err != nil {
+			return nil, err
+		}
+		return dialer.(netproxy.ContextDialer).DialContext(ctx, network, target)
+	}
+	return dialConnect(ctx, t.proxy, target)
+}
+
+// proxyAddr returns "host:port" of the proxy, with the default port of the scheme.
+func proxyAddr(proxy *url.URL) string {
+	if proxy.Port() != "" {
+		return proxy.Host
+	}
+	port := map[string]string{"http": "80", "https": "443", "socks5": "1080"}[proxy.Scheme]
+	return net.JoinHostPort(proxy.Hostname(), port)
+}
+
+/*
+ *  HTTP プロキシに CONNECT で target ("ip:port") へのトンネルを作る。https のプロキシとは TLS で接続する。
+ *  http:// の上流もトンネルを通すので、プロキシは上流のポート (80 など) への CONNECT を許可する必要がある。
+ */
+func dialConnect(ctx context.Context, proxy *url.URL, target string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if proxy.Scheme == "https" {
+		conn, err = dialTLS(proxyDialer, "tcp", proxyAddr(proxy), &tls.Config{ServerName: proxy.Hostname()}, defaultTLSHandshakeTimeout)
+	} else {
+		conn, err = proxyDialer.DialContext(ctx, "tcp", proxyAddr(proxy))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+	if u := proxy.User; u != nil {
+		password, _ := u.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+password)))
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy CONNECT %s: %s", target, res.Status)
+	}
+	return conn, nil
+}
+
+// domainProxy returns the proxy for the [domain] entry, or nil to connect directly.
+func domainProxy(c *tomlConfig, domain string, d domainConfig, global *url.URL) (*url.URL, error) {
+	switch d.Proxy {
+	case "":
+		if global == nil || c.noProxy.match(domain) {
+			return nil, nil
+		}
+		return global, nil
+	case proxyDirect:
+		return nil, nil
+	}
+	return parseProxyURL(d.Proxy)
+}
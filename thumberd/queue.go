@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+/*
+ *  ImageMagick のワーカー (セマフォ) の待ち行列
+ *  待ち時間の上限を超えた場合や、クライアントが切断した場合は処理をしない。
+ */
+
+const defaultMaxQueueWait = 10 * time.Second
+
+// Retry-After for the 503 response when the queue wait exceeds the limit, in seconds.
+const queueRetryAfter = "1"
+
+var errQueueTimeout = errors.New("timed out waiting for an ImageMagick worker")
+
+func maxQueueWait(c *tomlConfig) time.Duration {
+	if c.Http.MaxQueueWaitMs > 0 {
+		return time.Duration(c.Http.MaxQueueWaitMs) * time.Millisecond
+	}
+	return defaultMaxQueueWait
+}
+
+// acquireSemaphore waits for a slot of sem. The caller must release it with <-sem on success.
+func acquireSemaphore(ctx context.Context, sem chan int, maxWait time.Duration) error {
+	// 既に切断されている場合は、空きがあっても処理しない
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+	select {
+	case sem <- 1:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return errQueueTimeout
+	}
+}
+
+// waitWorker is acquireSemaphore recording the queue depth and the wait time in the metrics.
+func waitWorker(ctx context.Context, sem chan int, maxWait time.Duration) error {
+	waitStart := time.Now()
+	atomic.AddInt64(&metrics.semQueued, 1)
+	err := acquireSemaphore(ctx, sem, maxWait)
+	atomic.AddInt64(&metrics.semQueued, -1)
+	metrics.queueWait.observeDuration(time.Since(waitStart))
+	return err
+}
+
+// queueTimeoutResult asks the client to retry, since the workers are busy only for a while.
+func queueTimeoutResult() *thumbResult {
+	glog.Error(errQueueTimeout.Error(), http.StatusServiceUnavailable)
+	result := errorResult(http.StatusServiceUnavailable, errQueueTimeout.Error(), &http_stats.queue_timeout)
+	result.header = http.Header{"Retry-After": {queueRetryAfter}}
+	return result
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/smartnews/yoya-thumber/thumbnail"
+)
+
+func TestAcquireSemaphore(t *testing.T) {
+	sem := make(chan int, 1)
+	if err := acquireSemaphore(context.Background(), sem, time.Second); err != nil {
+		t.Fatalf("acquire should succeed, got %v", err)
+	}
+
+	// 空きが無い場合は maxWait で諦める
+	start := time.Now()
+	if err := acquireSemaphore(context.Background(), sem, 50*time.Millisecond); err != errQueueTimeout {
+		t.Errorf("err = %v, want errQueueTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("acquire should give up in 50ms, took %v", elapsed)
+	}
+
+	// 待っている間にクライアントが切断した
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	if err := acquireSemaphore(ctx, sem, 10*time.Second); err != context.Canceled {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+
+	// 切断済みなら空きがあっても処理しない
+	<-sem
+	if err := acquireSemaphore(ctx, sem, time.Second); err != context.Canceled {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+	if len(sem) != 0 {
+		t.Error("semaphore should not be acquired")
+	}
+}
+
+func TestRenderThumbnailWithCanceledRequest(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := httptest.NewRequest("GET", "/w=100/example.com/a.jpg", nil).WithContext(ctx)
+	params := thumbnail.ThumbnailParameters{Width: 100, ImageUrl: "example.com/a.jpg"}
+
+	result := renderThumbnail(r, config.Load().(*tomlConfig), params, "", nil, make(chan int, 1), nil)
+	if result.stat != &http_stats.canceled {
+		t.Errorf("canceled request should be skipped, got %d %s", result.status, result.message)
+	}
+}
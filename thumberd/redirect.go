@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/publicsuffix"
+)
+
+/*
+ *  上流のリダイレクト
+ *  [redirect] の設定で、リダイレクトの回数、https から http への変更、別のサイトへの移動を制限する。
+ *  各ホップの URL も最初の URL と同じ検査をする。(名前解決後の IP アドレスは接続時に検査する)
+ */
+
+const defaultMaxRedirects = 10
+
+// errRedirectRefused wraps the errors of the redirect policy. They are not retried.
+var errRedirectRefused = errors.New("redirect refused")
+
+// debugFinalURLHeader is set to the URL of the last request to the origin if [redirect] debug_header is true.
+const debugFinalURLHeader = "X-Thumber-Final-Url"
+
+func maxRedirects(c *tomlConfig) int {
+	switch {
+	case c.Redirect.MaxHops < 0:
+		return 0
+	case c.Redirect.MaxHops == 0:
+		return defaultMaxRedirects
+	}
+	return c.Redirect.MaxHops
+}
+
+/*
+ *  上流の URL を検査する。localhost とループバック、[security] で禁止された IP アドレスは断る。
+ */
+func checkUpstreamURL(u *url.URL) error {
+	// these codes are referencing net/http/transport.go useProxy method.
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("unsupported scheme: " + u.Scheme)
+	}
+	if u.Hostname() == "localhost" {
+		return errors.New("localhost is prohibited.")
+	}
+	if ip := net.ParseIP(u.Hostname()); ip != nil {
+		if ip.IsLoopback() {
+			return errors.New("loopback address is prohibited.")
+		}
+		if !getAddressPolicy().isAllowed(ip) {
+			return fmt.Errorf("%w: %s", errAddressProhibited, ip)
+		}
+	}
+	return nil
+}
+
+// site returns the registrable domain (eTLD+1) of the host, or the host itself for IP addresses and single labels.
+func site(u *url.URL) string {
+	host := strings.ToLower(u.Hostname())
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	if s, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil {
+		return s
+	}
+	return host
+}
+
+func redirectPolicy(c *tomlConfig, req *http.Request, via []*http.Request) error {
+	if len(via) > maxRedirects(c) {
+		return fmt.Errorf("%w: stopped after %d redirects", errRedirectRefused, maxRedirects(c))
+	}
+	prev := via[len(via)-1]
+	if prev.URL.Scheme == "https" && req.URL.Scheme != "https" && !c.Redirect.AllowDowngrade {
+		return fmt.Errorf("%w: https to %s", errRedirectRefused, req.URL.Scheme)
+	}
+	if c.Redirect.SameSite && site(req.URL) != site(via[0].URL) {
+		return fmt.Errorf("%w: to another site %s", errRedirectRefused, req.URL.Host)
+	}
+	if err := checkUpstreamURL(req.URL); err != nil {
+		return fmt.Errorf("%w: %s", errRedirectRefused, err)
+	}
+	return nil
+}
+
+// checkRedirect is http.Client.CheckRedirect for the upstream clients.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	from := via[len(via)-1].URL.String()
+	if err := redirectPolicy(config.Load().(*tomlConfig), req, via); err != nil {
+		glog.Warning(err.Error() + "\tfrom:" + from + "\tto:" + req.URL.String())
+		atomic.AddInt64(&http_stats.redirect_error, 1)
+		return err
+	}
+	glog.Info("redirect\tfrom:" + from + "\tto:" + req.URL.String())
+	atomic.AddInt64(&http_stats.upstream_redirect, 1)
+	return nil
+}
+
+// setFinalURL sets the debug header to the URL the response came from.
+func setFinalURL(c *tomlConfig, h http.Header, res *http.Response) {
+	if c.Redirect.DebugHeader && res.Request != nil {
+		h.Set(debugFinalURLHeader, res.Request.URL.String())
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func redirectRequest(t *testing.T, to string, via ...string) (*http.Request, []*http.Request) {
+	req, err := http.NewRequest("GET", to, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reqs []*http.Request
+	for _, u := range via {
+		r, _ := http.NewRequest("GET", u, nil)
+		reqs = append(reqs, r)
+	}
+	return req, reqs
+}
+
+func TestRedirectPolicy(t *testing.T) {
+	c := &tomlConfig{}
+	c.Redirect.MaxHops = 2
+	c.Redirect.SameSite = true
+	for _, tc := range []struct {
+		to  string
+		via []string
+		ok  bool
+	}{
+		{"https://b.example.com/a.jpg", []string{"https://a.example.com/"}, true},
+		{"https://example.com/a.jpg", []string{"https://a.example.com/", "https://b.example.com/"}, true},
+		{"https://example.com/a.jpg", []string{"https://a.example.com/", "https://b.example.com/", "https://c.example.com/"}, false},
+		{"http://b.example.com/a.jpg", []string{"https://a.example.com/"}, false},
+		{"https://b.example.com/a.jpg", []string{"http://a.example.com/"}, true},
+		{"https://example.org/a.jpg", []string{"https://a.example.com/"}, false},
+		{"https://b.example.co.uk/a.jpg", []string{"https://a.example.co.uk/"}, true},
+		{"https://other.co.uk/a.jpg", []string{"https://a.example.co.uk/"}, false},
+		// サイトは最初の URL と比べる
+		{"https://a.example.com/a.jpg", []string{"https://a.example.com/", "https://b.example.com/"}, true},
+	} {
+		req, via := redirectRequest(t, tc.to, tc.via...)
+		err := redirectPolicy(c, req, via)
+		if (err == nil) != tc.ok || (err != nil && !errors.Is(err, errRedirectRefused)) {
+			t.Errorf("%s via %v: %v", tc.to, tc.via, err)
+		}
+	}
+
+	c.Redirect.SameSite = false
+	c.Redirect.AllowDowngrade = true
+	for to, ok := range map[string]bool{
+		"http://example.org/a.jpg":    true,
+		"http://localhost/a.jpg":      false,
+		"http://127.0.0.1/a.jpg":      false,
+		"http://169.254.169.254/":     false,
+		"http://[fe80::1]/a.jpg":      false,
+		"ftp://example.org/a.jpg":     false,
+		"https://93.184.216.34/a.jpg": true,
+	} {
+		req, via := redirectRequest(t, to, "https://a.example.com/")
+		if err := redirectPolicy(c, req, via); (err == nil) != ok {
+			t.Errorf("%s: %v", to, err)
+		}
+	}
+
+	c.Redirect.MaxHops = -1
+	req, via := redirectRequest(t, "https://a.example.com/b.jpg", "https://a.example.com/")
+	if err := redirectPolicy(c, req, via); err == nil {
+		t.Error("redirects should not be followed with max_hops < 0")
+	}
+}
+
+func TestSite(t *testing.T) {
+	for raw, want := range map[string]string{
+		"https://img.cdn.Example.COM/a.jpg": "example.com",
+		"https://a.example.co.jp:8443/":     "example.co.jp",
+		"http://10.0.0.1/":                  "10.0.0.1",
+		"http://origin.test:8080/":          "origin.test",
+	} {
+		u, _ := url.Parse(raw)
+		if got := site(u); got != want {
+			t.Errorf("site(%s) = %q, want %q", raw, got, want)
+		}
+	}
+}
+
+func TestMyClientImageGetWithRedirects(t *testing.T) {
+	var requests int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/hop/"):
+			n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/hop/"))
+			if n > 0 {
+				http.Redirect(w, r, "/hop/"+strconv.Itoa(n-1), http.StatusFound)
+			} else {
+				http.Redirect(w, r, "/a.jpg", http.StatusFound)
+			}
+		case r.URL.Path == "/private":
+			http.Redirect(w, r, "http://10.0.0.1/a.jpg", http.StatusFound)
+		default:
+			w.Write([]byte("image"))
+		}
+	}))
+	defer origin.Close()
+	host, restore := useTestOrigin(t, origin)
+	defer restore()
+
+	old := config.Load().(*tomlConfig)
+	c := *old
+	c.Redirect.MaxHops = 2
+	c.Redirect.DebugHeader = true
+	config.Store(&c)
+	defer config.Store(old)
+
+	res, err, status := myClientImageGet(context.Background(), host+"/hop/1", "", "", "", nil)
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, %v", status, err)
+	}
+	res.Body.Close()
+	h := make(http.Header)
+	setFinalURL(&c, h, res)
+	if got := h.Get(debugFinalURLHeader); got != "http://"+host+"/a.jpg" {
+		t.Errorf("%s = %q", debugFinalURLHeader, got)
+	}
+
+	// 断ったリダイレクトはリトライしない
+	for _, path := range []string{"/hop/2", "/private"} {
+		atomic.StoreInt32(&requests, 0)
+		if _, err, status := myClientImageGet(context.Background(), host+path, "", "", "", nil); status != http.StatusBadRequest || !errors.Is(err, errRedirectRefused) {
+			t.Errorf("%s: status = %d, err = %v", path, status, err)
+		}
+		if n := atomic.LoadInt32(&requests); path == "/private" && n != 1 {
+			t.Errorf("%s: %d requests, want 1", path, n)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ *  上流のリトライとサーキットブレーカー (ホスト毎)
+ *  接続エラーと 502, 503, 504 はジッター付きの指数バックオフでリトライする。タイムアウトはリトライしない。
+ *  失敗 (リトライしても失敗したもの、タイムアウトを含む) が BreakerFailures 回続いたホストは、
+ *  BreakerCooldownMs の間 上流に問い合わせずに 503 を返す。その後 1つのリクエストだけを試しに通し (half-open)、
+ *  成功すれば元に戻し、失敗すればまた止める。
+ *  [domain."host"] の MaxRetries, RetryBackoffMs, RetryMaxBackoffMs, BreakerFailures, BreakerCooldownMs で変えられる。
+ */
+
+const (
+	defaultMaxRetries      = 2
+	defaultRetryBackoff    = 100 * time.Millisecond
+	defaultRetryMaxBackoff = time.Second
+	defaultBreakerFailures = 5
+	defaultBreakerCooldown = 30 * time.Second
+
+	// ブレーカーの状態を持つホストの最大数 (失敗したホストだけを持つ)
+	maxBreakers = 10000
+	// half-open で試しのリクエストを待つ間の Retry-After
+	halfOpenRetryAfter = time.Second
+)
+
+type upstreamPolicy struct {
+	maxRetries      int
+	retryBackoff    time.Duration
+	retryMaxBackoff time.Duration
+	breakerFailures int // 0 ならブレーカーを使わない
+	breakerCooldown time.Duration
+}
+
+var defaultUpstreamPolicy = upstreamPolicy{
+	maxRetries:      defaultMaxRetries,
+	retryBackoff:    defaultRetryBackoff,
+	retryMaxBackoff: defaultRetryMaxBackoff,
+	breakerFailures: defaultBreakerFailures,
+	breakerCooldown: defaultBreakerCooldown,
+}
+
+func loadUpstreamPolicies(c *tomlConfig) error {
+	c.upstreamPolicies = make(map[string]upstreamPolicy)
+	for domain, d := range c.Domain {
+		p := defaultUpstreamPolicy
+		for _, v := range []struct {
+			name  string
+			value *int
+			set   func(n int)
+		}{
+			{"MaxRetries", d.MaxRetries, func(n int) { p.maxRetries = n }},
+			{"RetryBackoffMs", d.RetryBackoffMs, func(n int) { p.retryBackoff = time.Duration(n) * time.Millisecond }},
+			{"RetryMaxBackoffMs", d.RetryMaxBackoffMs, func(n int) { p.retryMaxBackoff = time.Duration(n) * time.Millisecond }},
+			{"BreakerFailures", d.BreakerFailures, func(n int) { p.breakerFailures = n }},
+			{"BreakerCooldownMs", d.BreakerCooldownMs, func(n int) { p.breakerCooldown = time.Duration(n) * time.Millisecond }},
+		} {
+			if v.value == nil {
+				continue
+			}
+			if *v.value < 0 {
+				return fmt.Errorf("domain.%s: %s must not be negative", domain, v.name)
+			}
+			v.set(*v.value)
+		}
+		c.upstreamPolicies[domain] = p
+	}
+	return nil
+}
+
+func getUpstreamPolicy(c *tomlConfig, host string) upstreamPolicy {
+	if p, ok := c.upstreamPolicies[host]; ok {
+		return p
+	}
+	return defaultUpstreamPolicy
+}
+
+// backoff returns the wait before the retry after the attempt (0, 1, ...): a random duration in [d/2, d].
+func (p upstreamPolicy) backoff(attempt int) time.Duration {
+	d := p.retryBackoff << uint(attempt)
+	if d > p.retryMaxBackoff || d < p.retryBackoff {
+		d = p.retryMaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+/*
+ *  上流の失敗かどうか。
+ *  接続エラーと 502, 503, 504 はリトライする。タイムアウトは時間がかかるのでリトライしない。
+ *  それ以外の 4xx, 5xx は画像の問題なので失敗としない。接続先の検査やリダイレクトの制限で断った場合も失敗としない。
+ */
+func upstreamFailed(res *http.Response, err error) (failed, retryable bool) {
+	if errors.Is(err, errAddressProhibited) || errors.Is(err, errRedirectRefused) {
+		return false, false
+	}
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return true, false
+		}
+		return true, true
+	}
+	switch res.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true, true
+	}
+	return false, false
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half_open"
+	}
+	return "closed"
+}
+
+type breaker struct {
+	state     breakerState
+	failures  int // 続けて失敗した回数
+	openUntil time.Time
+}
+
+type breakerSet struct {
+	mu    sync.Mutex
+	hosts map[string]*breaker // 失敗したホストだけを持つ
+	now   func() time.Time
+}
+
+func newBreakerSet() *breakerSet {
+	return &breakerSet{hosts: make(map[string]*breaker), now: time.Now}
+}
+
+var breakers = newBreakerSet()
+
+// allow reports whether a request to host may be sent. If not, retryAfter is the time until the next try.
+func (s *breakerSet) allow(host string, p upstreamPolicy) (ok bool, retryAfter time.Duration) {
+	if p.breakerFailures == 0 {
+		return true, 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.hosts[host]
+	if b == nil {
+		return true, 0
+	}
+	switch b.state {
+	case breakerOpen:
+		now := s.now()
+		if now.Before(b.openUntil) {
+			return false, b.openUntil.Sub(now)
+		}
+		// このリクエストを試しに通す
+		b.state = breakerHalfOpen
+	case breakerHalfOpen:
+		return false, halfOpenRetryAfter
+	}
+	return true, 0
+}
+
+func (s *breakerSet) report(host string, p upstreamPolicy, failed bool) {
+	if p.breakerFailures == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !failed {
+		delete(s.hosts, host)
+		return
+	}
+	b := s.hosts[host]
+	if b == nil {
+		if len(s.hosts) >= maxBreakers {
+			return
+		}
+		b = &breaker{}
+		s.hosts[host] = b
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= p.breakerFailures) {
+		b.state = breakerOpen
+		b.openUntil = s.now().Add(p.breakerCooldown)
+		atomic.AddInt64(&http_stats.breaker_opened, 1)
+	}
+}
+
+type breakerStatus struct {
+	host     string
+	state    breakerState
+	failures int
+}
+
+// status returns the hosts which are failing, sorted by host.
+func (s *breakerSet) status() []breakerStatus {
+	s.mu.Lock()
+	list := make([]breakerStatus, 0, len(s.hosts))
+	for host, b := range s.hosts {
+		list = append(list, breakerStatus{host, b.state, b.failures})
+	}
+	s.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].host < list[j].host })
+	return list
+}
+
+// cancel gives the trial request of half-open to the next request, when the client has gone before the result.
+func (s *breakerSet) cancel(host string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b := s.hosts[host]; b != nil && b.state == breakerHalfOpen {
+		b.state = breakerOpen
+		b.openUntil = s.now()
+	}
+}
+
+/*
+ *  上流へのリクエスト do をリトライとサーキットブレーカー付きで呼ぶ。
+ *  ブレーカーが開いている場合は、上流に問い合わせずに 503 を返す。
+ *  クライアントが切断した (ctx が終わった) 場合は、バックオフを待たずにやめる。上流の失敗とはしない。
+ */
+func fetchWithRetry(ctx context.Context, host string, p upstreamPolicy, do func() (*http.Response, error)) (*http.Response, error) {
+	if ok, retryAfter := breakers.allow(host, p); !ok {
+		atomic.AddInt64(&http_stats.breaker_rejected, 1)
+		seconds := int((retryAfter + time.Second - 1) / time.Second)
+		h := http.Header{"Retry-After": {strconv.Itoa(seconds)}}
+		return originResponse(http.StatusServiceUnavailable, h, nil, 0), nil
+	}
+	for attempt := 0; ; attempt++ {
+		res, err := do()
+		if err != nil && ctx.Err() != nil {
+			breakers.cancel(host)
+			return nil, err
+		}
+		failed, retryable := upstreamFailed(res, err)
+		if !failed || !retryable || attempt >= p.maxRetries {
+			breakers.report(host, p, failed)
+			return res, err
+		}
+		if res != nil {
+			io.Copy(ioutil.Discard, io.LimitReader(res.Body, 4096))
+			res.Body.Close()
+		}
+		atomic.AddInt64(&http_stats.upstream_retry, 1)
+		timer := time.NewTimer(p.backoff(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			breakers.cancel(host)
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// upstreamStatusError is the error for 4xx and 5xx from the upstream. retryAfter is its Retry-After header.
+type upstreamStatusError struct {
+	status     string
+	retryAfter string
+}
+
+func (e *upstreamStatusError) Error() string {
+	return "upstream status:" + e.status
+}
+
+/*
+ *  上流から取得できなかった場合の結果
+ *  上流 (開いているブレーカーを含む) の Retry-After はクライアントに渡す。
+ *  クライアントが切断して取得をやめた場合は canceled にして、集約していたリクエストがやり直せるようにする。
+ */
+func upstreamErrorResult(r *http.Request, err error, status int, message string) *thumbResult {
+	if ctxErr := r.Context().Err(); ctxErr != nil {
+		return canceledResult(ctxErr)
+	}
+	result := errorResult(status, message, &http_stats.upstream_error)
+	if se, ok := err.(*upstreamStatusError); ok && se.retryAfter != "" {
+		result.header = http.Header{"Retry-After": {se.retryAfter}}
+	}
+	return result
+}
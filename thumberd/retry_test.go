@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func intPtr(n int) *int { return &n }
+
+func TestLoadUpstreamPolicies(t *testing.T) {
+	c := &tomlConfig{Domain: map[string]domainConfig{
+		"a.example.com": {MaxRetries: intPtr(0), BreakerCooldownMs: intPtr(500), MaxHeaderListSize: 1},
+	}}
+	if err := loadUpstreamPolicies(c); err != nil {
+		t.Fatal(err)
+	}
+	p := getUpstreamPolicy(c, "a.example.com")
+	if p.maxRetries != 0 || p.breakerCooldown != 500*time.Millisecond || p.breakerFailures != defaultBreakerFailures {
+		t.Errorf("policy = %+v", p)
+	}
+	if p := getUpstreamPolicy(c, "b.example.com"); p != defaultUpstreamPolicy {
+		t.Errorf("policy = %+v, want the default", p)
+	}
+
+	c = &tomlConfig{Domain: map[string]domainConfig{"a.example.com": {MaxRetries: intPtr(-1)}}}
+	if err := loadUpstreamPolicies(c); err == nil {
+		t.Error("negative MaxRetries should be an error")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	p := upstreamPolicy{retryBackoff: 100 * time.Millisecond, retryMaxBackoff: 300 * time.Millisecond}
+	for attempt, max := range []time.Duration{100, 200, 300, 300, 300} {
+		max *= time.Millisecond
+		for i := 0; i < 20; i++ {
+			if d := p.backoff(attempt); d < max/2 || d > max {
+				t.Errorf("backoff(%d) = %v, want [%v, %v]", attempt, d, max/2, max)
+			}
+		}
+	}
+	if d := p.backoff(100); d > 300*time.Millisecond {
+		t.Errorf("backoff(100) = %v", d)
+	}
+	if d := (upstreamPolicy{}).backoff(0); d != 0 {
+		t.Errorf("backoff without delay = %v", d)
+	}
+}
+
+func TestUpstreamFailed(t *testing.T) {
+	for _, c := range []struct {
+		res               *http.Response
+		err               error
+		failed, retryable bool
+	}{
+		{&http.Response{StatusCode: http.StatusOK}, nil, false, false},
+		{&http.Response{StatusCode: http.StatusNotFound}, nil, false, false},
+		{&http.Response{StatusCode: http.StatusInternalServerError}, nil, false, false},
+		{&http.Response{StatusCode: http.StatusBadGateway}, nil, true, true},
+		{&http.Response{StatusCode: http.StatusGatewayTimeout}, nil, true, true},
+		{nil, errors.New("connection reset by peer"), true, true},
+		{nil, timeoutError{}, true, false},
+		{nil, &url.Error{Op: "Get", Err: &net.OpError{Op: "dial", Err: errAddressProhibited}}, false, false},
+	} {
+		failed, retryable := upstreamFailed(c.res, c.err)
+		if failed != c.failed || retryable != c.retryable {
+			t.Errorf("%v %v: failed = %t, retryable = %t", c.res, c.err, failed, retryable)
+		}
+	}
+}
+
+func TestBreakerSet(t *testing.T) {
+	now := time.Unix(0, 0)
+	s := newBreakerSet()
+	s.now = func() time.Time { return now }
+	p := upstreamPolicy{breakerFailures: 2, breakerCooldown: 10 * time.Second}
+
+	s.report("a", p, true)
+	if ok, _ := s.allow("a", p); !ok {
+		t.Fatal("should be closed after one failure")
+	}
+	s.report("a", p, true)
+	if ok, retryAfter := s.allow("a", p); ok || retryAfter != 10*time.Second {
+		t.Fatalf("should be open, got %t, %v", ok, retryAfter)
+	}
+	if ok, _ := s.allow("b", p); !ok {
+		t.Error("other hosts should not be affected")
+	}
+
+	// cooldown の後は 1つだけ通す
+	now = now.Add(10 * time.Second)
+	if ok, _ := s.allow("a", p); !ok {
+		t.Fatal("the probe should be allowed")
+	}
+	if ok, _ := s.allow("a", p); ok {
+		t.Error("only one probe should be allowed")
+	}
+	if st := s.status(); len(st) != 1 || st[0].state != breakerHalfOpen || st[0].failures != 2 {
+		t.Errorf("status = %+v", st)
+	}
+	s.report("a", p, true)
+	if ok, _ := s.allow("a", p); ok {
+		t.Error("a failed probe should open the breaker again")
+	}
+
+	now = now.Add(10 * time.Second)
+	s.allow("a", p)
+	s.report("a", p, false)
+	if ok, _ := s.allow("a", p); !ok || len(s.status()) != 0 {
+		t.Error("a successful probe should close the breaker")
+	}
+
+	// BreakerFailures = 0 では使わない
+	off := upstreamPolicy{}
+	for i := 0; i < 10; i++ {
+		s.report("c", off, true)
+	}
+	if ok, _ := s.allow("c", off); !ok {
+		t.Error("the breaker should be disabled")
+	}
+}
+
+func TestFetchWithRetry(t *testing.T) {
+	p := upstreamPolicy{maxRetries: 2, breakerFailures: 1, breakerCooldown: time.Minute}
+	host := t.Name()
+	defer func() { breakers.report(host, p, false) }()
+
+	var calls int
+	statuses := []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusOK}
+	res, err := fetchWithRetry(context.Background(), host, p, func() (*http.Response, error) {
+		calls++
+		return originResponse(statuses[calls-1], nil, nil, 0), nil
+	})
+	if err != nil || res.StatusCode != http.StatusOK || calls != 3 {
+		t.Errorf("status = %v, err = %v, calls = %d", res, err, calls)
+	}
+
+	// タイムアウトはリトライしないが、ブレーカーには数える
+	calls = 0
+	_, err = fetchWithRetry(context.Background(), host, p, func() (*http.Response, error) {
+		calls++
+		return nil, timeoutError{}
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("err = %v, calls = %d", err, calls)
+	}
+	res, err = fetchWithRetry(context.Background(), host, p, func() (*http.Response, error) {
+		t.Error("should not be called while the breaker is open")
+		return nil, nil
+	})
+	if err != nil || res.StatusCode != http.StatusServiceUnavailable || res.Header.Get("Retry-After") != "60" {
+		t.Errorf("status = %v, err = %v", res, err)
+	}
+}
+
+func TestFetchWithRetryCanceled(t *testing.T) {
+	p := upstreamPolicy{maxRetries: 2, retryBackoff: time.Minute, retryMaxBackoff: time.Minute, breakerFailures: 1, breakerCooldown: time.Minute}
+	host := t.Name()
+	defer func() { breakers.report(host, p, false) }()
+
+	// クライアントが切断したら、バックオフを待たずにやめる
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls int
+	start := time.Now()
+	_, err := fetchWithRetry(ctx, host, p, func() (*http.Response, error) {
+		calls++
+		cancel()
+		return originResponse(http.StatusServiceUnavailable, nil, nil, 0), nil
+	})
+	if err != context.Canceled || calls != 1 || time.Since(start) > 10*time.Second {
+		t.Errorf("err = %v, calls = %d, elapsed = %v", err, calls, time.Since(start))
+	}
+	// 上流の失敗とはしない
+	if ok, _ := breakers.allow(host, p); !ok {
+		t.Error("the breaker should not be opened by the canceled request")
+	}
+}
+
+func TestMyClientImageGetWithRetry(t *testing.T) {
+	var calls int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("image"))
+	}))
+	defer origin.Close()
+	host, restore := useTestOrigin(t, origin)
+	defer restore()
+
+	old := config.Load().(*tomlConfig)
+	c := *old
+	c.Domain = map[string]domainConfig{host: {RetryBackoffMs: intPtr(1), BreakerFailures: intPtr(1)}}
+	if err := loadUpstreamPolicies(&c); err != nil {
+		t.Fatal(err)
+	}
+	config.Store(&c)
+	defer config.Store(old)
+
+	res, err, status := myClientImageGet(context.Background(), host+"/a.jpg", "", "", "", nil)
+	if status != http.StatusOK {
+		t.Fatalf("status = %d, err = %v", status, err)
+	}
+	res.Body.Close()
+	if calls != 2 {
+		t.Errorf("calls = %d, want 2", calls)
+	}
+
+	// ブレーカーの状態は /server-status に出る
+	origin.Close()
+	if _, _, status := myClientImageGet(context.Background(), host+"/a.jpg", "", "", "", nil); status != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", status)
+	}
+	if _, _, status := myClientImageGet(context.Background(), host+"/a.jpg", "", "", "", nil); status != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", status)
+	}
+	// 開いているブレーカーの Retry-After はクライアントに返す
+	rec := httptest.NewRecorder()
+	newTestHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/w=100,url="+host+"/a.jpg", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("status = %d, Retry-After = %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	rec = httptest.NewRecorder()
+	statusServer(rec, httptest.NewRequest("GET", "/server-status", nil))
+	if !strings.Contains(rec.Body.String(), "breaker "+host+" open 1\n") {
+		t.Errorf("/server-status does not show the breaker:\n%s", rec.Body.String())
+	}
+	breakers.report(host, getUpstreamPolicy(&c, host), false)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+/*
+ *  Graceful shutdown
+ *  SIGTERM/SIGINT を受けたら /healthz, /readyz を失敗させてロードバランサから外れるのを待ち、
+ *  新しい接続の受付を止めて、処理中のリクエスト (http_stats.inflight) が終わってから終了する。
+ */
+
+const defaultShutdownTimeout = 30 * time.Second
+
+var shuttingDown int32
+
+func isShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) != 0
+}
+
+func shutdownDurations(c *tomlConfig) (delay, timeout time.Duration) {
+	delay = time.Duration(c.Http.ShutdownDelay) * time.Second
+	timeout = time.Duration(c.Http.ShutdownTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	return delay, timeout
+}
+
+// waitInflight waits until no thumbnail request is being served.
+func waitInflight(ctx context.Context) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&http_stats.inflight) > 0 {
+		select {
+		case <-ctx.Done():
+			return errors.New("shutdown timed out with in-flight requests")
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+/*
+ *  delay の間は /healthz だけを失敗させて受付を続け、その後 srv を止める。
+ *  処理中のリクエストは timeout (delay を含まない) まで待つ。
+ *  FastCGI の場合は srv が起動していないので、http_stats.inflight だけを見る。
+ */
+func gracefulShutdown(srv *http.Server, delay, timeout time.Duration) error {
+	atomic.StoreInt32(&shuttingDown, 1)
+	if delay > 0 {
+		glog.Infof("draining for %v", delay)
+		time.Sleep(delay)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		return err
+	}
+	return waitInflight(ctx)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowServer serves requests counted in http_stats.inflight until release is closed.
+func slowServer(release chan struct{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&http_stats.inflight, 1)
+		defer atomic.AddInt64(&http_stats.inflight, -1)
+		<-release
+		w.Write([]byte("done"))
+	}))
+}
+
+func waitForInflight(t *testing.T, n int64) {
+	for i := 0; atomic.LoadInt64(&http_stats.inflight) != n; i++ {
+		if i > 100 {
+			t.Fatalf("inflight should be %d", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	defer atomic.StoreInt32(&shuttingDown, 0)
+
+	release := make(chan struct{})
+	ts := slowServer(release)
+	defer ts.Close()
+
+	res_chan := make(chan *http.Response, 1)
+	go func() {
+		res, err := http.Get(ts.URL)
+		if err != nil {
+			t.Error(err)
+		}
+		res_chan <- res
+	}()
+	waitForInflight(t, 1)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- gracefulShutdown(ts.Config, 0, 5*time.Second)
+	}()
+
+	// 処理中のリクエストが終わるまでは終了しない
+	select {
+	case err := <-done:
+		t.Fatalf("shutdown should wait for the in-flight request, got %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	rec := httptest.NewRecorder()
+	healthServer(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("/healthz should be 503 while shutting down, got %d", rec.Code)
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Errorf("shutdown failed: %v", err)
+	}
+	if res := <-res_chan; res == nil || res.StatusCode != 200 {
+		t.Error("the in-flight request should be completed")
+	} else {
+		res.Body.Close()
+	}
+}
+
+func TestGracefulShutdownTimeout(t *testing.T) {
+	defer atomic.StoreInt32(&shuttingDown, 0)
+
+	release := make(chan struct{})
+	ts := slowServer(release)
+	defer ts.Close()
+	defer close(release)
+
+	go func() {
+		if res, err := http.Get(ts.URL); err == nil {
+			res.Body.Close()
+		}
+	}()
+	waitForInflight(t, 1)
+
+	if err := gracefulShutdown(ts.Config, 0, 100*time.Millisecond); err == nil {
+		t.Error("shutdown should time out")
+	}
+}
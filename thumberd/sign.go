@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/smartnews/yoya-thumber/signature"
+)
+
+func signatureKeys(c *tomlConfig) [][]byte {
+	keys := make([][]byte, 0, len(c.Security.Keys))
+	for _, key := range c.Security.Keys {
+		keys = append(keys, []byte(key))
+	}
+	return keys
+}
+
+/*
+ *  thumberd sign <path>...
+ *  [security] の先頭の鍵で署名したパスを出力する。
+ *  example: thumberd sign "/w=100,h=100,url=example.com%2Fa.jpg"
+ */
+func signCommand(paths []string) int {
+	c := config.Load().(*tomlConfig)
+	if len(c.Security.Keys) == 0 {
+		fmt.Fprintln(os.Stderr, "no keys in [security] section")
+		return 1
+	}
+	if len(paths) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: thumberd sign <path>...")
+		return 1
+	}
+	for _, path := range paths {
+		fmt.Println(signature.SignPath([]byte(c.Security.Keys[0]), path))
+	}
+	return 0
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+/*
+ *  SSRF 対策
+ *  上流への接続時 (名前解決の後、リダイレクトの各ホップ毎) に接続先 IP アドレスを検査する。
+ *  名前解決の結果で判定するので、DNS rebinding にも効く。
+ */
+
+// Networks which upstream requests must not reach unless explicitly allowed.
+var defaultDenyNetworks = []string{
+	"0.0.0.0/8",      // "this" network
+	"10.0.0.0/8",     // private
+	"100.64.0.0/10",  // carrier-grade NAT
+	"127.0.0.0/8",    // loopback
+	"169.254.0.0/16", // link-local (including cloud metadata 169.254.169.254)
+	"172.16.0.0/12",  // private
+	"192.0.0.0/24",   // IETF protocol assignments
+	"192.168.0.0/16", // private
+	"198.18.0.0/15",  // benchmarking
+	"224.0.0.0/4",    // multicast
+	"240.0.0.0/4",    // reserved, broadcast
+	"::/128",         // unspecified
+	"::1/128",        // loopback
+	"64:ff9b::/96",   // IPv4/IPv6 translation
+	"fc00::/7",       // unique local address
+	"fe80::/10",      // link-local
+	"ff00::/8",       // multicast
+}
+
+// errAddressProhibited is returned when connecting to an address prohibited by the policy.
+var errAddressProhibited = errors.New("upstream address is prohibited")
+
+type addressPolicy struct {
+	allow       []*net.IPNet
+	deny        []*net.IPNet
+	defaultDeny []*net.IPNet
+}
+
+func parseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func newAddressPolicy(allow, deny []string) (*addressPolicy, error) {
+	var p addressPolicy
+	var err error
+	if p.allow, err = parseNetworks(allow); err != nil {
+		return nil, err
+	}
+	if p.deny, err = parseNetworks(deny); err != nil {
+		return nil, err
+	}
+	if p.defaultDeny, err = parseNetworks(defaultDenyNetworks); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAllowed checks the configured deny list first, then the allow list,
+// and finally the default deny list.
+func (p *addressPolicy) isAllowed(ip net.IP) bool {
+	if containsIP(p.deny, ip) {
+		return false
+	}
+	if containsIP(p.allow, ip) {
+		return true
+	}
+	return !containsIP(p.defaultDeny, ip)
+}
+
+// checkAddress checks the "host:port" address which is about to be dialed.
+func (p *addressPolicy) checkAddress(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return errors.New("upstream address is not an IP address: " + host)
+	}
+	if !p.isAllowed(ip) {
+		return fmt.Errorf("%w: %s", errAddressProhibited, ip)
+	}
+	return nil
+}
+
+var addrPolicy atomic.Value
+
+func getAddressPolicy() *addressPolicy {
+	return addrPolicy.Load().(*addressPolicy)
+}
+
+func setupAddressPolicy(c *tomlConfig) error {
+	p, err := newAddressPolicy(c.Security.AllowNetworks, c.Security.DenyNetworks)
+	if err != nil {
+		return err
+	}
+	addrPolicy.Store(p)
+	return nil
+}
+
+// newUpstreamDialer returns a dialer which refuses to connect to addresses
+// prohibited by the policy.
+func newUpstreamDialer(policy func() *addressPolicy) *net.Dialer {
+	return &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			return policy().checkAddress(address)
+		},
+	}
+}
+
+// dialTLS is for http2.Transport.DialTLS. The handshake fails after handshakeTimeout.
+func dialTLS(dialer *net.Dialer, network, addr string, cfg *tls.Config, handshakeTimeout time.Duration) (net.Conn, error) {
+	conn, err := dialer.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, cfg)
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// stubResolver returns a resolver which answers from hosts instead of the real DNS.
+func stubResolver(hosts map[string][]string) *net.Resolver {
+	return lookupResolver(func(name string, qtype dnsmessage.Type) []string { return hosts[name] })
+}
+
+// lookupResolver returns a resolver which answers the addresses returned by lookup.
+// The addresses are filtered by the query type (A or AAAA).
+func lookupResolver(lookup func(name string, qtype dnsmessage.Type) []string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go serveStubDNS(server, lookup)
+			return client, nil
+		},
+	}
+}
+
+// useTestOrigin lets the upstream client connect to origin as "origin.test",
+// and returns its host:port and a function to restore the resolver and the policy.
+func useTestOrigin(t *testing.T, origin *httptest.Server) (string, func()) {
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(origin.URL, "http://"))
+	oldResolver := upstreamDialer.Resolver
+	upstreamDialer.Resolver = stubResolver(map[string][]string{"origin.test": {"127.0.0.1"}})
+	oldPolicy := getAddressPolicy()
+	p, err := newAddressPolicy([]string{"127.0.0.1/32"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrPolicy.Store(p)
+	return "origin.test:" + port, func() {
+		upstreamDialer.Resolver = oldResolver
+		addrPolicy.Store(oldPolicy)
+	}
+}
+
+// serveStubDNS answers DNS queries in the TCP framing, which the Go resolver
+// uses for connections that are not net.PacketConn.
+func serveStubDNS(conn net.Conn, lookup func(name string, qtype dnsmessage.Type) []string) {
+	defer conn.Close()
+	for {
+		var length uint16
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			return
+		}
+		buf := make([]byte, length)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		var query dnsmessage.Message
+		if err := query.Unpack(buf); err != nil || len(query.Questions) == 0 {
+			return
+		}
+		q := query.Questions[0]
+		res := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: query.ID, Response: true, Authoritative: true},
+			Questions: query.Questions,
+		}
+		for _, addr := range lookup(strings.TrimSuffix(q.Name.String(), "."), q.Type) {
+			ip := net.ParseIP(addr)
+			hdr := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}
+			if ip4 := ip.To4(); ip4 != nil && q.Type == dnsmessage.TypeA {
+				var a dnsmessage.AResource
+				copy(a.A[:], ip4)
+				hdr.Type = dnsmessage.TypeA
+				res.Answers = append(res.Answers, dnsmessage.Resource{Header: hdr, Body: &a})
+			} else if ip.To4() == nil && q.Type == dnsmessage.TypeAAAA {
+				var aaaa dnsmessage.AAAAResource
+				copy(aaaa.AAAA[:], ip)
+				hdr.Type = dnsmessage.TypeAAAA
+				res.Answers = append(res.Answers, dnsmessage.Resource{Header: hdr, Body: &aaaa})
+			}
+		}
+		packed, err := res.Pack()
+		if err != nil {
+			return
+		}
+		binary.Write(conn, binary.BigEndian, uint16(len(packed)))
+		conn.Write(packed)
+	}
+}
+
+func TestAddressPolicy(t *testing.T) {
+	cases := []struct {
+		ip      string
+		allow   []string
+		deny    []string
+		allowed bool
+	}{
+		{"93.184.216.34", nil, nil, true},
+		{"2606:2800:220:1:248:1893:25c8:1946", nil, nil, true},
+		{"127.0.0.1", nil, nil, false},
+		{"10.1.2.3", nil, nil, false},
+		{"172.16.0.1", nil, nil, false},
+		{"172.32.0.1", nil, nil, true},
+		{"192.168.1.1", nil, nil, false},
+		{"169.254.169.254", nil, nil, false},
+		{"0.0.0.0", nil, nil, false},
+		{"::1", nil, nil, false},
+		{"::ffff:10.0.0.1", nil, nil, false},
+		{"fd00::1", nil, nil, false},
+		{"fe80::1", nil, nil, false},
+		{"10.1.2.3", []string{"10.1.0.0/16"}, nil, true},
+		{"10.1.2.3", []string{"10.0.0.0/8"}, []string{"10.1.2.0/24"}, false},
+		{"93.184.216.34", nil, []string{"93.184.216.0/24"}, false},
+	}
+	for _, c := range cases {
+		p, err := newAddressPolicy(c.allow, c.deny)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.isAllowed(net.ParseIP(c.ip)); got != c.allowed {
+			t.Errorf("isAllowed(%s) allow:%v deny:%v = %v, want %v", c.ip, c.allow, c.deny, got, c.allowed)
+		}
+	}
+}
+
+func TestNewAddressPolicyWithInvalidNetwork(t *testing.T) {
+	if _, err := newAddressPolicy([]string{"10.0.0.0"}, nil); err == nil {
+		t.Error("invalid CIDR should be an error")
+	}
+}
+
+func TestUpstreamDialer(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "http://private.test"+r.URL.Query().Get("port")+"/", http.StatusFound)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer origin.Close()
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(origin.URL, "http://"))
+
+	resolver := stubResolver(map[string][]string{
+		"origin.test":    {"127.0.0.1"},
+		"private.test":   {"10.0.0.1"},
+		"metadata.test":  {"169.254.169.254"},
+		"ula.test":       {"fd00::1"},
+		"linklocal.test": {"fe80::1"},
+		"mixed.test":     {"192.168.0.1", "127.0.0.1"},
+	})
+
+	cases := []struct {
+		url   string
+		allow []string
+		ok    bool
+	}{
+		{"http://origin.test:" + port + "/", []string{"127.0.0.1/32"}, true},
+		// a public name resolving to loopback (DNS rebinding)
+		{"http://origin.test:" + port + "/", nil, false},
+		{"http://private.test:" + port + "/", nil, false},
+		{"http://metadata.test:" + port + "/", nil, false},
+		{"http://ula.test:" + port + "/", nil, false},
+		{"http://linklocal.test:" + port + "/", nil, false},
+		// every resolved address is checked
+		{"http://mixed.test:" + port + "/", []string{"127.0.0.1/32"}, true},
+		{"http://mixed.test:" + port + "/", nil, false},
+		// redirect hops are checked too
+		{"http://origin.test:" + port + "/redirect?port=:" + port, []string{"127.0.0.1/32"}, false},
+	}
+	for _, c := range cases {
+		p, err := newAddressPolicy(c.allow, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dialer := newUpstreamDialer(func() *addressPolicy { return p })
+		dialer.Resolver = resolver
+		client := http.Client{Transport: &http.Transport{DialContext: dialer.DialContext}}
+
+		res, err := client.Get(c.url)
+		if err == nil {
+			res.Body.Close()
+		}
+		if c.ok && err != nil {
+			t.Errorf("%s allow:%v should succeed, got %v", c.url, c.allow, err)
+		}
+		if !c.ok && (err == nil || !strings.Contains(err.Error(), "prohibited")) {
+			t.Errorf("%s allow:%v should be prohibited, got %v", c.url, c.allow, err)
+		}
+	}
+}
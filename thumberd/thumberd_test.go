@@ -1,15 +1,24 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+
+	"github.com/smartnews/yoya-thumber/signature"
+	"github.com/smartnews/yoya-thumber/thumbnail"
 )
 
 func TestThumbServer(t *testing.T) {
-	ts := httptest.NewServer(http.HandlerFunc(thumbServer))
+	ts := httptest.NewServer(newTestHandler())
 
 	res, err := http.Get(ts.URL)
 	if err != nil {
@@ -22,12 +31,16 @@ func TestThumbServer(t *testing.T) {
 	}
 }
 
+func newTestHandler() http.Handler {
+	return &Handler{sem: make(chan int, 1)}
+}
+
 func originImageHandler(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, "../test-image/test001.jpg")
 }
 
 func TestThumbServerWithSuccessCase(t *testing.T) {
-	ts := httptest.NewServer(http.HandlerFunc(thumbServer))
+	ts := httptest.NewServer(newTestHandler())
 	defer ts.Close()
 
 	origin := httptest.NewServer(http.HandlerFunc(originImageHandler))
@@ -47,7 +60,7 @@ func TestThumbServerWithSuccessCase(t *testing.T) {
 }
 
 func BenchmarkThumbServer(b *testing.B) {
-	ts := httptest.NewServer(http.HandlerFunc(thumbServer))
+	ts := httptest.NewServer(newTestHandler())
 	defer ts.Close()
 
 	origin := httptest.NewServer(http.HandlerFunc(originImageHandler))
@@ -68,7 +81,7 @@ func BenchmarkThumbServer(b *testing.B) {
 }
 
 func TestThumbServerWithInvalidParam(t *testing.T) {
-	ts := httptest.NewServer(http.HandlerFunc(thumbServer))
+	ts := httptest.NewServer(newTestHandler())
 	defer ts.Close()
 
 	res, err := http.Get(ts.URL + "/w=abc,h=100,q=0.9/")
@@ -82,6 +95,31 @@ func TestThumbServerWithInvalidParam(t *testing.T) {
 	}
 }
 
+func TestThumbServerWithInvalidSignature(t *testing.T) {
+	ts := httptest.NewServer(newTestHandler())
+	defer ts.Close()
+
+	old := config.Load().(*tomlConfig)
+	c := *old
+	c.Security.Keys = []string{"secret"}
+	config.Store(&c)
+	defer config.Store(old)
+
+	for _, path := range []string{
+		"/w=100,h=100,url=example.com/a.jpg",
+		"/w=100,h=100,url=example.com/a.jpg,sig=" + signature.Sign([]byte("other"), []string{"w=100", "h=100", "url=example.com/a.jpg"}),
+	} {
+		res, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Error("unexpected")
+			return
+		}
+		if res.StatusCode != 403 {
+			t.Error("Status code should be 403, but got ", res.StatusCode)
+		}
+	}
+}
+
 func TestStatusServer(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(statusServer))
 	defer ts.Close()
@@ -111,3 +149,76 @@ func TestNotFound(t *testing.T) {
 		return
 	}
 }
+
+func TestParseSourceRegion(t *testing.T) {
+	cases := []struct {
+		s    string
+		want thumbnail.SourceRegion
+		ok   bool
+	}{
+		{"10,20,100,50", thumbnail.SourceRegion{X: 10, Y: 20, Width: 100, Height: 50}, true},
+		{"0r,0.5r,1r,0.5r", thumbnail.SourceRegion{X: 0, Y: 0.5, Width: 1, Height: 0.5, Ratio: true}, true},
+		{"0.3r,0r,0.7r,1r", thumbnail.SourceRegion{X: 0.3, Y: 0, Width: 0.7, Height: 1, Ratio: true}, true},
+		// 比率の印が無ければ 1 は 1 ピクセル
+		{"0,0,1,1", thumbnail.SourceRegion{X: 0, Y: 0, Width: 1, Height: 1}, true},
+		{"0r,0r,1r,1r", thumbnail.SourceRegion{X: 0, Y: 0, Width: 1, Height: 1, Ratio: true}, true},
+		{"0.5r,0r,0.6r,1r", thumbnail.SourceRegion{}, false},
+		{"0,0.5,1,0.5", thumbnail.SourceRegion{}, false},
+		{"0,0.5r,100,0.5r", thumbnail.SourceRegion{}, false},
+		{"10,20,100.0,50", thumbnail.SourceRegion{}, false},
+		{"NaNr,0r,1r,1r", thumbnail.SourceRegion{}, false},
+		{"r,0r,1r,1r", thumbnail.SourceRegion{}, false},
+		{"10,20,0,50", thumbnail.SourceRegion{}, false},
+		{"-1,20,100,50", thumbnail.SourceRegion{}, false},
+		{"10,20,100", thumbnail.SourceRegion{}, false},
+		{"a,b,c,d", thumbnail.SourceRegion{}, false},
+	}
+	for _, c := range cases {
+		got, err := parseSourceRegion(c.s)
+		if (err == nil) != c.ok {
+			t.Errorf("parseSourceRegion(%q): err = %v", c.s, err)
+			continue
+		}
+		if c.ok && got != c.want {
+			t.Errorf("parseSourceRegion(%q) = %+v, want %+v", c.s, got, c.want)
+		}
+	}
+}
+
+func TestThumbServerSourceRegionDecodedSmaller(t *testing.T) {
+	// 左半分が赤、右半分が青の 1600x800 の JPEG
+	img := image.NewRGBA(image.Rect(0, 0, 1600, 800))
+	draw.Draw(img, image.Rect(0, 0, 800, 800), image.NewUniform(color.RGBA{255, 0, 0, 255}), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(800, 0, 1600, 800), image.NewUniform(color.RGBA{0, 0, 255, 255}), image.Point{}, draw.Src)
+	var src bytes.Buffer
+	jpeg.Encode(&src, img, &jpeg.Options{Quality: 95})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(src.Bytes())
+	}))
+	defer origin.Close()
+	host, restore := useTestOrigin(t, origin)
+	defer restore()
+	ts := httptest.NewServer(newTestHandler())
+	defer ts.Close()
+
+	// どちらも右側の青い領域。jpeg:size で 1/8 にデコードしても、sc は元画像の座標で切り出す
+	for _, sc := range []string{"900%2C0%2C700%2C800", "0.5625r%2C0r%2C0.4375r%2C1r"} {
+		res, err := http.Get(ts.URL + "/w=20,h=20,fo=png,cdbg=1,sc=" + sc + ",url=" + host + "/a.jpg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := png.Decode(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK || err != nil {
+			t.Errorf("sc=%s: status = %d, %v", sc, res.StatusCode, err)
+			continue
+		}
+		if size := res.Header.Get("X-Thumber-Decode"); size != "200x100" {
+			t.Errorf("sc=%s: decoded at %s, want 200x100", sc, size)
+		}
+		r, _, b, _ := out.At(out.Bounds().Dx()/2, out.Bounds().Dy()/2).RGBA()
+		if r>>8 > 32 || b>>8 < 224 {
+			t.Errorf("sc=%s: the region should be blue, got r=%d b=%d", sc, r>>8, b>>8)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+/*
+ *  上流への HTTP クライアント
+ *  [domain."host"] の Transport は設定の読み込み時に作り、SIGHUP で設定と一緒に入れ替える。
+ *  (リクエスト毎に作ると keep-alive のコネクションや TLS セッションを再利用できない)
+ *  Transport の設定が無いホストは defaultTransport (プロキシを使う場合はプロキシ経由の Transport) を共有する。
+ *  Transport はリクエスト毎 (リダイレクトの各ホップ毎) にホスト名で選ぶ。
+ */
+
+const (
+	defaultIdleConnTimeout     = 90 * time.Second
+	defaultTLSHandshakeTimeout = 10 * time.Second
+)
+
+// [domain."host"] 上流のホスト毎の設定
+type domainConfig struct {
+	MaxHeaderListSize  uint32
+	DisableCompression bool
+	// 暗号化しない HTTP/2 (h2c) を使う。Http1Fallback とは併用できない
+	AllowHTTP bool
+	// HTTP/2 に対応していないホストには HTTP/1.1 を使う (false なら HTTP/2 のみ)
+	Http1Fallback bool
+	// コネクションプール。MaxIdleConns, MaxIdleConnsPerHost, MaxConnsPerHost は Http1Fallback の場合のみ
+	// (HTTP/2 のみの場合は 1つのコネクションを多重化する)
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	MaxConnsPerHost       int
+	IdleConnTimeoutMs     int // 0 なら 90000
+	TLSHandshakeTimeoutMs int // 0 なら 10000
+	// プロキシ (proxy.go)。空なら [proxy] の設定、"direct" なら直接接続
+	Proxy string
+
+	// リトライとサーキットブレーカー (retry.go)。省略するとデフォルト値
+	MaxRetries        *int
+	RetryBackoffMs    *int
+	RetryMaxBackoffMs *int
+	BreakerFailures   *int
+	BreakerCooldownMs *int
+}
+
+// hasTransport reports whether the entry has settings of the transport. Entries without them use defaultTransport.
+func (d *domainConfig) hasTransport() bool {
+	return d.MaxHeaderListSize != 0 || d.DisableCompression || d.AllowHTTP || d.Http1Fallback ||
+		d.MaxIdleConns != 0 || d.MaxIdleConnsPerHost != 0 || d.MaxConnsPerHost != 0 ||
+		d.IdleConnTimeoutMs != 0 || d.TLSHandshakeTimeoutMs != 0
+}
+
+func (d *domainConfig) validate() error {
+	if d.AllowHTTP && d.Http1Fallback {
+		return errors.New("AllowHTTP can't be used with Http1Fallback")
+	}
+	for name, n := range map[string]int{
+		"MaxIdleConns":          d.MaxIdleConns,
+		"MaxIdleConnsPerHost":   d.MaxIdleConnsPerHost,
+		"MaxConnsPerHost":       d.MaxConnsPerHost,
+		"IdleConnTimeoutMs":     d.IdleConnTimeoutMs,
+		"TLSHandshakeTimeoutMs": d.TLSHandshakeTimeoutMs,
+	} {
+		if n < 0 {
+			return errors.New(name + " must not be negative")
+		}
+	}
+	return nil
+}
+
+func msOrDefault(ms int, def time.Duration) time.Duration {
+	if ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return def
+}
+
+// newDomainTransport returns the transport for the [domain] entry. With a proxy, HTTP/2 is used only if it is negotiated.
+func newDomainTransport(d domainConfig, proxy *url.URL) http.RoundTripper {
+	idleConnTimeout := msOrDefault(d.IdleConnTimeoutMs, defaultIdleConnTimeout)
+	handshakeTimeout := msOrDefault(d.TLSHandshakeTimeoutMs, defaultTLSHandshakeTimeout)
+	tlsConfig := &tls.Config{ClientSessionCache: tls.NewLRUClientSessionCache(0)}
+
+	if d.Http1Fallback || proxy != nil {
+		// ALPN で HTTP/2 が選ばれなければ HTTP/1.1 を使う
+		t := newDefaultTransport()
+		var rt http.RoundTripper = t
+		if proxy != nil {
+			pt := newProxyTransport(proxy)
+			t, rt = pt.Transport, pt
+		}
+		t.ForceAttemptHTTP2 = true
+		t.TLSClientConfig = tlsConfig
+		t.DisableCompression = d.DisableCompression
+		t.MaxResponseHeaderBytes = int64(d.MaxHeaderListSize)
+		t.MaxIdleConns = d.MaxIdleConns
+		t.MaxIdleConnsPerHost = d.MaxIdleConnsPerHost
+		t.MaxConnsPerHost = d.MaxConnsPerHost
+		t.IdleConnTimeout = idleConnTimeout
+		t.TLSHandshakeTimeout = handshakeTimeout
+		return rt
+	}
+	return &http2.Transport{
+		TLSClientConfig:    tlsConfig,
+		MaxHeaderListSize:  d.MaxHeaderListSize,
+		DisableCompression: d.DisableCompression,
+		AllowHTTP:          d.AllowHTTP,
+		IdleConnTimeout:    idleConnTimeout,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return dialTLS(upstreamDialer, network, addr, cfg, handshakeTimeout)
+		},
+	}
+}
+
+func loadTransports(c *tomlConfig) error {
+	global, err := parseProxyURL(c.Proxy.Url)
+	if err != nil {
+		return fmt.Errorf("proxy.url: %s", err)
+	}
+	if c.noProxy, err = parseNoProxy(c.Proxy.NoProxy); err != nil {
+		return fmt.Errorf("proxy.no_proxy: %s", err)
+	}
+	c.proxyTransport = nil
+	if global != nil {
+		c.proxyTransport = newProxyTransport(global)
+	}
+
+	c.transports = make(map[string]http.RoundTripper)
+	for domain, d := range c.Domain {
+		if err := d.validate(); err != nil {
+			return fmt.Errorf("domain.%s: %s", domain, err)
+		}
+		proxy, err := domainProxy(c, domain, d, global)
+		if err != nil {
+			return fmt.Errorf("domain.%s: Proxy: %s", domain, err)
+		}
+		switch {
+		case proxy != nil && d.AllowHTTP:
+			return fmt.Errorf("domain.%s: AllowHTTP can't be used with a proxy", domain)
+		case d.hasTransport() || proxy != nil:
+			c.transports[domain] = newDomainTransport(d, proxy)
+		case d.Proxy == proxyDirect:
+			c.transports[domain] = defaultTransport
+		}
+	}
+	return nil
+}
+
+// transportFor returns the transport for the host ("host:port" or "host") of a request.
+func transportFor(c *tomlConfig, host string) http.RoundTripper {
+	if t, ok := c.transports[host]; ok {
+		return t
+	}
+	if c.proxyTransport != nil && !c.noProxy.match(host) {
+		return c.proxyTransport
+	}
+	return defaultTransport
+}
+
+// upstreamTransport chooses the transport for each request, so that redirects to other hosts use their settings.
+type upstreamTransport struct {
+	c *tomlConfig
+}
+
+func (t upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return transportFor(t.c, req.URL.Host).RoundTrip(req)
+}
+
+// closeIdleTransports closes the idle connections of the transports of the old config after SIGHUP.
+func closeIdleTransports(c *tomlConfig) {
+	var transports []http.RoundTripper
+	if c.proxyTransport != nil {
+		transports = append(transports, c.proxyTransport)
+	}
+	for _, t := range c.transports {
+		transports = append(transports, t)
+	}
+	for _, t := range transports {
+		if t == http.RoundTripper(defaultTransport) {
+			continue
+		}
+		if t, ok := t.(interface{ CloseIdleConnections() }); ok {
+			t.CloseIdleConnections()
+		}
+	}
+}
+
+var upstreamDialer = newUpstreamDialer(getAddressPolicy)
+
+// defaultTransport is shared by the domains not configured in [domain].
+// Proxies from the environment are not used, because the SSRF check would only see the proxy address.
+var defaultTransport = newDefaultTransport()
+
+func newDefaultTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	t.DialContext = upstreamDialer.DialContext
+	t.TLSClientConfig = &tls.Config{ClientSessionCache: tls.NewLRUClientSessionCache(0)}
+	return t
+}
+
+func getHttpClient() http.Client {
+	return http.Client{
+		Timeout:       time.Duration(*timeout) * time.Second,
+		Transport:     upstreamTransport{config.Load().(*tomlConfig)},
+		CheckRedirect: checkRedirect,
+	}
+}
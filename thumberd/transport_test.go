@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+func TestLoadTransports(t *testing.T) {
+	c := &tomlConfig{Domain: map[string]domainConfig{
+		"h2.example.com":       {MaxHeaderListSize: 32768, IdleConnTimeoutMs: 1000},
+		"fallback.example.com": {Http1Fallback: true, MaxConnsPerHost: 8, TLSHandshakeTimeoutMs: 2000},
+		"retry.example.com":    {MaxRetries: intPtr(1)},
+	}}
+	if err := loadTransports(c); err != nil {
+		t.Fatal(err)
+	}
+	if h2, ok := c.transports["h2.example.com"].(*http2.Transport); !ok || h2.MaxHeaderListSize != 32768 || h2.IdleConnTimeout != time.Second {
+		t.Errorf("h2.example.com: %#v", c.transports["h2.example.com"])
+	}
+	if h1, ok := c.transports["fallback.example.com"].(*http.Transport); !ok || h1.MaxConnsPerHost != 8 ||
+		h1.TLSHandshakeTimeout != 2*time.Second || h1.IdleConnTimeout != defaultIdleConnTimeout || !h1.ForceAttemptHTTP2 {
+		t.Errorf("fallback.example.com: %#v", c.transports["fallback.example.com"])
+	}
+	if _, ok := c.transports["retry.example.com"]; ok {
+		t.Error("entries without transport settings should use the default transport")
+	}
+
+	for _, d := range []domainConfig{
+		{AllowHTTP: true, Http1Fallback: true},
+		{MaxIdleConns: -1},
+	} {
+		c := &tomlConfig{Domain: map[string]domainConfig{"a.example.com": d}}
+		if err := loadTransports(c); err == nil {
+			t.Errorf("%+v should be an error", d)
+		}
+	}
+}
+
+/*
+ *  HTTP/1.1 だけの TLS サーバで、Http1Fallback とコネクションの再利用を確かめる。
+ *  httptest の証明書は example.com 用なので、example.com を 127.0.0.1 に向ける。
+ */
+func TestDomainTransport(t *testing.T) {
+	var conns int32
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("image"))
+	}))
+	origin.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	origin.StartTLS()
+	defer origin.Close()
+	_, port, _ := net.SplitHostPort(origin.Listener.Addr().String())
+	host := "example.com:" + port
+
+	oldResolver := upstreamDialer.Resolver
+	upstreamDialer.Resolver = stubResolver(map[string][]string{"example.com": {"127.0.0.1"}})
+	defer func() { upstreamDialer.Resolver = oldResolver }()
+	oldPolicy := getAddressPolicy()
+	p, _ := newAddressPolicy([]string{"127.0.0.1/32"}, nil)
+	addrPolicy.Store(p)
+	defer addrPolicy.Store(oldPolicy)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(origin.Certificate())
+	useDomain := func(d domainConfig) *tomlConfig {
+		c := *config.Load().(*tomlConfig)
+		c.Domain = map[string]domainConfig{host: d}
+		if err := loadTransports(&c); err != nil {
+			t.Fatal(err)
+		}
+		switch tr := c.transports[host].(type) {
+		case *http.Transport:
+			tr.TLSClientConfig.RootCAs = roots
+		case *http2.Transport:
+			tr.TLSClientConfig.RootCAs = roots
+		}
+		config.Store(&c)
+		return &c
+	}
+	defer config.Store(config.Load())
+
+	c := useDomain(domainConfig{Http1Fallback: true})
+	for i := 0; i < 3; i++ {
+		res, err, status := myClientImageGet(context.Background(), "https://"+host+"/a.jpg", "", "", "", nil)
+		if status != http.StatusOK {
+			t.Fatalf("status = %d, %v", status, err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("%d connections, want 1", n)
+	}
+	if transportFor(c, host) != c.transports[host] {
+		t.Error("the transport should be reused")
+	}
+
+	// SIGHUP で作り直した Transport は新しいコネクションを使う
+	useDomain(domainConfig{Http1Fallback: true})
+	closeIdleTransports(c)
+	res, _, status := myClientImageGet(context.Background(), "https://"+host+"/a.jpg", "", "", "", nil)
+	if status != http.StatusOK {
+		t.Fatalf("status = %d", status)
+	}
+	res.Body.Close()
+	if n := atomic.LoadInt32(&conns); n != 2 {
+		t.Errorf("%d connections, want 2", n)
+	}
+
+	// HTTP/2 のみの場合は HTTP/1.1 のサーバに接続できない
+	useDomain(domainConfig{MaxHeaderListSize: 32768, MaxRetries: intPtr(0)})
+	if _, _, status := myClientImageGet(context.Background(), "https://"+host+"/a.jpg", "", "", "", nil); status == http.StatusOK {
+		t.Error("HTTP/2 only transport should not fall back to HTTP/1.1")
+	}
+}
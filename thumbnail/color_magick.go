@@ -0,0 +1,51 @@
+package thumbnail
+
+import (
+	"strings"
+
+	"github.com/golang/glog"
+	"gopkg.in/gographics/imagick.v2/imagick"
+)
+
+/*
+ * 色空間の変換
+ * ICC プロファイル付きの画像 (Display P3, Adobe RGB, CMYK など) は sRGB に変換してから処理する。
+ */
+
+// sRGBProfile と defaultCMYKProfile はビルド時に profiles_gen.go に埋め込む (gen_profiles.go)
+//go:generate go run gen_profiles.go
+
+/*
+ * 埋め込まれた ICC プロファイルから sRGB に変換する。
+ * プロファイルの無い CMYK 画像は cmykProfile (nil なら内蔵の FOGRA39 の defaultCMYKProfile) で変換する。
+ * embed が false の場合は、変換後に ICC プロファイルを外す。
+ */
+func convertToSRGB(mw *imagick.MagickWand, cmykProfile []byte, embed bool) error {
+	hasProfile := len(mw.GetImageProfile("icc")) > 0
+
+	if !hasProfile && mw.GetImageColorspace() == imagick.COLORSPACE_CMYK {
+		if len(cmykProfile) == 0 {
+			cmykProfile = defaultCMYKProfile
+		}
+		// プロファイルの無い画像に対しては、変換せずに割り当てるだけ
+		if err := mw.ProfileImage("icc", cmykProfile); err != nil {
+			glog.Error("ProfileImage(CMYK) failed: " + err.Error())
+			return err
+		}
+		hasProfile = true
+	}
+
+	// 既に sRGB のプロファイルなら画素の変換は不要
+	if hasProfile && !strings.HasPrefix(mw.GetImageProperty("icc:description"), "sRGB") {
+		if err := mw.ProfileImage("icc", sRGBProfile); err != nil {
+			glog.Error("ProfileImage(sRGB) failed: " + err.Error())
+			return err
+		}
+	}
+
+	if embed {
+		return mw.SetImageProfile("icc", sRGBProfile)
+	}
+	mw.RemoveImageProfile("icc")
+	return nil
+}
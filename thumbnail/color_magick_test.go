@@ -0,0 +1,128 @@
+package thumbnail
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/png"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"gopkg.in/gographics/imagick.v2/imagick"
+)
+
+// renderPNG makes an 8x8 PNG thumbnail of the fixture and returns the body.
+func renderPNG(t *testing.T, name string, embed bool) []byte {
+	src, err := ioutil.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return renderBlobPNG(t, src, embed)
+}
+
+func renderBlobPNG(t *testing.T, src []byte, embed bool) []byte {
+	params := ThumbnailParameters{
+		Width:        8,
+		Height:       8,
+		Quality:      90,
+		Background:   "white",
+		FormatOutput: "png",
+		MaxPixels:    1000000,
+		EmbedProfile: embed,
+	}
+	rec := httptest.NewRecorder()
+	if err := MakeThumbnailMagick(src, rec, params); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Body.Bytes()
+}
+
+func TestConvertToSRGB(t *testing.T) {
+	cases := []struct {
+		name    string
+		r, g, b int
+	}{
+		// Display P3 の (180,120,90) を sRGB に変換した値
+		{"p3.png", 190, 117, 84},
+		// cmyk.jpg と同じ CMYK (0.2,0.4,0.6,0.1) にテスト用の新聞用プロファイルが埋め込まれている
+		{"cmyk-profile.jpg", 184, 144, 120},
+	}
+	for _, c := range cases {
+		body := renderPNG(t, c.name, false)
+		img, err := png.Decode(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(c.name, err)
+		}
+		r, g, b, _ := img.At(4, 4).RGBA()
+		got := []int{int(r >> 8), int(g >> 8), int(b >> 8)}
+		want := []int{c.r, c.g, c.b}
+		for i := range got {
+			if d := got[i] - want[i]; d < -3 || d > 3 {
+				t.Errorf("%s: got rgb%v, want rgb%v", c.name, got, want)
+				break
+			}
+		}
+		if bytes.Contains(body, []byte("iCCP")) {
+			t.Errorf("%s: ICC profile should be removed", c.name)
+		}
+	}
+}
+
+func TestConvertToSRGBWithEmbedProfile(t *testing.T) {
+	body := renderPNG(t, "p3.png", true)
+	if !bytes.Contains(body, []byte("iCCP")) {
+		t.Error("sRGB profile should be embedded")
+	}
+}
+
+func TestConvertUntaggedCMYK(t *testing.T) {
+	// プロファイルの無い CMYK は、内蔵の FOGRA39 が埋め込まれている場合と同じに変換する
+	src, err := ioutil.ReadFile("testdata/cmyk.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mw := imagick.NewMagickWand()
+	defer mw.Destroy()
+	if err := mw.ReadImageBlob(src); err != nil {
+		t.Fatal(err)
+	}
+	if err := mw.SetImageProfile("icc", defaultCMYKProfile); err != nil {
+		t.Fatal(err)
+	}
+	tagged, err := mw.GetImageBlob()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	untagged, err := png.Decode(bytes.NewReader(renderPNG(t, "cmyk.jpg", false)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := png.Decode(bytes.NewReader(renderBlobPNG(t, tagged, false)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := untagged.At(4, 4), want.At(4, 4); got != want {
+		t.Errorf("untagged CMYK = %v, want %v", got, want)
+	}
+}
+
+func TestBuiltinProfiles(t *testing.T) {
+	for _, c := range []struct {
+		name       string
+		profile    []byte
+		colorSpace string
+	}{
+		{"sRGBProfile", sRGBProfile, "RGB "},
+		{"defaultCMYKProfile", defaultCMYKProfile, "CMYK"},
+	} {
+		p := c.profile
+		if len(p) < 128 || int(binary.BigEndian.Uint32(p)) != len(p) || string(p[36:40]) != "acsp" {
+			t.Errorf("%s is not an ICC profile", c.name)
+			continue
+		}
+		if string(p[16:20]) != c.colorSpace {
+			t.Errorf("%s: colour space %q, want %q", c.name, p[16:20], c.colorSpace)
+		}
+	}
+}
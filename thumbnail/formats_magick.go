@@ -0,0 +1,49 @@
+package thumbnail
+
+import (
+	"strings"
+
+	"gopkg.in/gographics/imagick.v2/imagick"
+)
+
+/*
+ * リンクされている delegate で各フォーマットの書き出しができるかを調べる。
+ * QueryFormats に載っていても delegate が無いと書き出せない場合があるので、
+ * 実際に小さな画像をエンコードしてみる。(heic は 16 ピクセル未満の画像を扱えない)
+ */
+func ProbeOutputFormats(formats []string) map[string]bool {
+	supported := make(map[string]bool, len(formats))
+
+	pw := imagick.NewPixelWand()
+	defer pw.Destroy()
+	pw.SetColor("#80808080")
+
+	for _, format := range formats {
+		mw := imagick.NewMagickWand()
+		err := mw.NewImage(16, 16, pw)
+		if err == nil {
+			err = mw.SetImageFormat(strings.ToUpper(format))
+		}
+		var blob []byte
+		if err == nil {
+			blob, err = mw.GetImageBlob()
+		}
+		mw.Destroy()
+		supported[format] = err == nil && len(blob) > 0
+	}
+	return supported
+}
+
+/*
+ * 画像が透明度を持つかを返す。(ヘッダの情報だけで判定する)
+ */
+func HasAlphaChannel(bytes []byte) (bool, error) {
+	mw := imagick.NewMagickWand()
+	defer mw.Destroy()
+
+	if err := mw.PingImageBlob(bytes); err != nil {
+		return false, err
+	}
+	mw.SetFirstIterator()
+	return mw.GetImageAlphaChannel(), nil
+}
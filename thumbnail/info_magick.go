@@ -0,0 +1,64 @@
+package thumbnail
+
+import (
+	"gopkg.in/gographics/imagick.v2/imagick"
+)
+
+// ImageInfo is the metadata of an image read without decoding the pixels.
+type ImageInfo struct {
+	// Width and Height are after the EXIF Orientation is applied.
+	Width       int
+	Height      int
+	Frames      int
+	Orientation int // EXIF Orientation (0 if undefined)
+	ColorSpace  string
+	Alpha       bool
+}
+
+var colorSpaceNames = map[imagick.ColorspaceType]string{
+	imagick.COLORSPACE_SRGB:  "sRGB",
+	imagick.COLORSPACE_RGB:   "RGB",
+	imagick.COLORSPACE_SCRGB: "scRGB",
+	imagick.COLORSPACE_GRAY:  "Gray",
+	imagick.COLORSPACE_CMYK:  "CMYK",
+	imagick.COLORSPACE_CMY:   "CMY",
+	imagick.COLORSPACE_LAB:   "Lab",
+	imagick.COLORSPACE_XYZ:   "XYZ",
+	imagick.COLORSPACE_YCBCR: "YCbCr",
+}
+
+func colorSpaceName(colorSpace imagick.ColorspaceType) string {
+	if name, ok := colorSpaceNames[colorSpace]; ok {
+		return name
+	}
+	return "Other"
+}
+
+/*
+ * 画像のメタデータを ping で読む (ピクセルは展開しない)
+ * アニメーションのフレーム数以外は最初のフレームの値
+ */
+func ImageInfoMagick(bytes []byte) (*ImageInfo, error) {
+	mw := imagick.NewMagickWand()
+	defer mw.Destroy()
+
+	if err := mw.PingImageBlob(bytes); err != nil {
+		return nil, err
+	}
+	frames := int(mw.GetNumberImages())
+	mw.SetFirstIterator()
+
+	orientation := mw.GetImageOrientation()
+	width, height := int(mw.GetImageWidth()), int(mw.GetImageHeight())
+	if isOrientationTransposed(orientation) {
+		width, height = height, width
+	}
+	return &ImageInfo{
+		Width:       width,
+		Height:      height,
+		Frames:      frames,
+		Orientation: int(orientation),
+		ColorSpace:  colorSpaceName(mw.GetImageColorspace()),
+		Alpha:       mw.GetImageAlphaChannel(),
+	}, nil
+}
@@ -0,0 +1,59 @@
+package thumbnail
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/png"
+	"io/ioutil"
+	"testing"
+)
+
+func TestImageInfoMagick(t *testing.T) {
+	cmyk, err := ioutil.ReadFile("testdata/cmyk.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := ImageInfoMagick(cmyk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ColorSpace != "CMYK" || info.Frames != 1 || info.Alpha {
+		t.Errorf("unexpected info for cmyk.jpg: %+v", info)
+	}
+
+	// 半透明の PNG
+	img := image.NewNRGBA(image.Rect(0, 0, 30, 20))
+	img.Set(0, 0, color.NRGBA{255, 0, 0, 128})
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	info, err = ImageInfoMagick(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Width != 30 || info.Height != 20 || !info.Alpha || info.ColorSpace != "sRGB" {
+		t.Errorf("unexpected info for png: %+v", info)
+	}
+
+	// 3 フレームのアニメーション GIF
+	anim := &gif.GIF{}
+	for i := 0; i < 3; i++ {
+		anim.Image = append(anim.Image, image.NewPaletted(image.Rect(0, 0, 16, 8), palette.Plan9))
+		anim.Delay = append(anim.Delay, 10)
+	}
+	buf.Reset()
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatal(err)
+	}
+	info, err = ImageInfoMagick(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Frames != 3 || info.Width != 16 || info.Height != 8 {
+		t.Errorf("unexpected info for gif: %+v", info)
+	}
+}
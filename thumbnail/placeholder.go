@@ -0,0 +1,165 @@
+package thumbnail
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"strings"
+)
+
+/*
+ * プレースホルダ用の色と BlurHash (https://blurha.sh)
+ * 小さく縮小した画像から計算する。透明なピクセルは無視する (半透明は不透明度で重み付けする)。
+ */
+
+var ErrInvalidBlurHashComponents = errors.New("blurhash components must be between 1 and 9")
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+func encodeBase83(value, length int) string {
+	var b strings.Builder
+	divisor := 1
+	for i := 1; i < length; i++ {
+		divisor *= 83
+	}
+	for ; divisor > 0; divisor /= 83 {
+		b.WriteByte(base83Chars[(value/divisor)%83])
+	}
+	return b.String()
+}
+
+func sRGBToLinear(v uint8) float64 {
+	x := float64(v) / 255
+	if x <= 0.04045 {
+		return x / 12.92
+	}
+	return math.Pow((x+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	x := math.Max(0, math.Min(1, v))
+	if x <= 0.0031308 {
+		return int(x*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(x, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+/*
+ * BlurHash を計算する。xComponents, yComponents は横と縦の DCT の成分数 (1〜9)
+ */
+func blurHash(img *image.NRGBA, xComponents, yComponents int) (string, error) {
+	if xComponents < 1 || xComponents > 9 || yComponents < 1 || yComponents > 9 {
+		return "", ErrInvalidBlurHashComponents
+	}
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	if width == 0 || height == 0 {
+		return "", errors.New("empty image")
+	}
+
+	// 線形 RGB に変換しておく
+	linear := make([][3]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := img.PixOffset(img.Rect.Min.X+x, img.Rect.Min.Y+y)
+			p := img.Pix[i : i+4]
+			linear[y*width+x] = [3]float64{sRGBToLinear(p[0]), sRGBToLinear(p[1]), sRGBToLinear(p[2])}
+		}
+	}
+
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			var f [3]float64
+			for y := 0; y < height; y++ {
+				basisY := math.Cos(math.Pi * float64(j) * float64(y) / float64(height))
+				for x := 0; x < width; x++ {
+					basis := normalisation * basisY * math.Cos(math.Pi*float64(i)*float64(x)/float64(width))
+					c := linear[y*width+x]
+					f[0] += basis * c[0]
+					f[1] += basis * c[1]
+					f[2] += basis * c[2]
+				}
+			}
+			scale := 1 / float64(width*height)
+			factors = append(factors, [3]float64{f[0] * scale, f[1] * scale, f[2] * scale})
+		}
+	}
+
+	var hash strings.Builder
+	hash.WriteString(encodeBase83((xComponents-1)+(yComponents-1)*9, 1))
+
+	dc, ac := factors[0], factors[1:]
+	maximumValue := 1.0
+	if len(ac) > 0 {
+		actualMaximum := 0.0
+		for _, f := range ac {
+			actualMaximum = math.Max(actualMaximum, math.Max(math.Abs(f[0]), math.Max(math.Abs(f[1]), math.Abs(f[2]))))
+		}
+		quantisedMaximum := int(math.Max(0, math.Min(82, math.Floor(actualMaximum*166-0.5))))
+		maximumValue = float64(quantisedMaximum+1) / 166
+		hash.WriteString(encodeBase83(quantisedMaximum, 1))
+	} else {
+		hash.WriteString(encodeBase83(0, 1))
+	}
+
+	hash.WriteString(encodeBase83(linearToSRGB(dc[0])<<16|linearToSRGB(dc[1])<<8|linearToSRGB(dc[2]), 4))
+	for _, f := range ac {
+		quantise := func(v float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maximumValue, 0.5)*9+9.5))))
+		}
+		hash.WriteString(encodeBase83(quantise(f[0])*19*19+quantise(f[1])*19+quantise(f[2]), 2))
+	}
+	return hash.String(), nil
+}
+
+func hexColor(r, g, b float64) string {
+	return fmt.Sprintf("#%02x%02x%02x", int(r+0.5), int(g+0.5), int(b+0.5))
+}
+
+/*
+ * 平均色と、最も多い色 (RGB を 4bit ずつに量子化して数えた中で、最も多い区画の平均色)
+ * 全て透明な場合は "" を返す。
+ */
+func placeholderColors(img *image.NRGBA) (dominant, average string) {
+	type bin struct{ r, g, b, weight float64 }
+	var bins [1 << 12]bin
+	var total bin
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+			i := img.PixOffset(x, y)
+			p := img.Pix[i : i+4]
+			weight := float64(p[3]) / 255
+			if weight == 0 {
+				continue
+			}
+			b := &bins[int(p[0]>>4)<<8|int(p[1]>>4)<<4|int(p[2]>>4)]
+			for _, acc := range []*bin{b, &total} {
+				acc.r += float64(p[0]) * weight
+				acc.g += float64(p[1]) * weight
+				acc.b += float64(p[2]) * weight
+				acc.weight += weight
+			}
+		}
+	}
+	if total.weight == 0 {
+		return "", ""
+	}
+	best := &bins[0]
+	for i := range bins {
+		if bins[i].weight > best.weight {
+			best = &bins[i]
+		}
+	}
+	dominant = hexColor(best.r/best.weight, best.g/best.weight, best.b/best.weight)
+	average = hexColor(total.r/total.weight, total.g/total.weight, total.b/total.weight)
+	return dominant, average
+}
@@ -0,0 +1,139 @@
+package thumbnail
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	"image/png"
+	"net/http"
+
+	"gopkg.in/gographics/imagick.v2/imagick"
+)
+
+// 色と BlurHash を計算する画像の長辺のピクセル数
+const placeholderSampleSize = 32
+
+// LQIP の WebP の画質
+const lqipQuality = 40
+
+// Placeholder is shown before the thumbnail is loaded.
+type Placeholder struct {
+	DominantColor string // "#rrggbb"
+	AverageColor  string // "#rrggbb"
+	BlurHash      string
+	LQIP          []byte // WebP (nil if params.LQIPSize is 0)
+}
+
+// blobWriter keeps the output of MakeThumbnailMagick in memory.
+type blobWriter struct {
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (w *blobWriter) Header() http.Header         { return w.header }
+func (w *blobWriter) Write(b []byte) (int, error) { return w.body.Write(b) }
+func (w *blobWriter) WriteHeader(int)             {}
+
+/*
+ * サムネールと同じパラメータで長辺 32px に縮小した画像から、プレースホルダを作る。
+ * デコードは MakeThumbnailMagick と同じ (jpeg:size で小さくデコードする)。
+ * 上書き画像とアノテーションは使わない。
+ */
+func MakePlaceholderMagick(blob []byte, params ThumbnailParameters) (*Placeholder, error) {
+	if params.BlurHashX < 1 || params.BlurHashX > 9 || params.BlurHashY < 1 || params.BlurHashY > 9 {
+		return nil, ErrInvalidBlurHashComponents
+	}
+
+	// 出力のアスペクト比を保って長辺を 32px にする
+	switch {
+	case params.Width == 0 && params.Height == 0:
+		params.Width, params.Height = placeholderSampleSize, placeholderSampleSize
+		params.CropMode = 0
+		params.ForceAspect = false
+	case params.Height == 0:
+		params.Width = placeholderSampleSize
+	case params.Width == 0:
+		params.Height = placeholderSampleSize
+	case params.Width >= params.Height:
+		params.Height = max1(roundInt(float64(params.Height) * placeholderSampleSize / float64(params.Width)))
+		params.Width = placeholderSampleSize
+	default:
+		params.Width = max1(roundInt(float64(params.Width) * placeholderSampleSize / float64(params.Height)))
+		params.Height = placeholderSampleSize
+	}
+	params.Upscale = true
+	params.FormatOutput = "png"
+	params.Animate = false
+	params.ImageOverlap = nil
+	params.Text = ""
+	params.KeepProfiles = nil
+	params.EmbedProfile = false
+	params.HttpAvoidChunk = false
+	params.CropDebug = false
+
+	w := &blobWriter{header: make(http.Header)}
+	if err := MakeThumbnailMagick(blob, w, params); err != nil {
+		return nil, err
+	}
+	decoded, err := png.Decode(&w.body)
+	if err != nil {
+		return nil, err
+	}
+	img := image.NewNRGBA(decoded.Bounds())
+	draw.Draw(img, img.Rect, decoded, decoded.Bounds().Min, draw.Src)
+
+	placeholder := &Placeholder{}
+	placeholder.DominantColor, placeholder.AverageColor = placeholderColors(img)
+	placeholder.BlurHash, err = blurHash(img, params.BlurHashX, params.BlurHashY)
+	if err != nil {
+		return nil, err
+	}
+	if params.LQIPSize > 0 {
+		placeholder.LQIP, err = makeLQIP(img, params.LQIPSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return placeholder, nil
+}
+
+func max1(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+/*
+ * 長辺 size ピクセルの WebP を作る (data URI で埋め込む小さな画像)
+ */
+func makeLQIP(img *image.NRGBA, size int) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+
+	mw := imagick.NewMagickWand()
+	defer mw.Destroy()
+	if err := mw.ReadImageBlob(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	width, height := float64(img.Rect.Dx()), float64(img.Rect.Dy())
+	scale := float64(size) / width
+	if height > width {
+		scale = float64(size) / height
+	}
+	if scale < 1 {
+		if err := mw.ResizeImage(uint(max1(roundInt(width*scale))), uint(max1(roundInt(height*scale))), imagick.FILTER_UNDEFINED, 1); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.SetImageFormat("webp"); err != nil {
+		return nil, err
+	}
+	if err := mw.SetImageCompressionQuality(lqipQuality); err != nil {
+		return nil, err
+	}
+	mw.StripImage()
+	return mw.GetImageBlob()
+}
@@ -0,0 +1,49 @@
+package thumbnail
+
+import (
+	"bytes"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func TestMakePlaceholderMagick(t *testing.T) {
+	img := filledImage(400, 200, func(x, y int) color.NRGBA { return color.NRGBA{255, 0, 0, 255} })
+	var src bytes.Buffer
+	if err := png.Encode(&src, img); err != nil {
+		t.Fatal(err)
+	}
+	params := ThumbnailParameters{
+		Width:     300,
+		Height:    100,
+		CropMode:  1,
+		Gravity:   5,
+		Quality:   90,
+		MaxPixels: 1000000,
+		BlurHashX: 4,
+		BlurHashY: 3,
+		LQIPSize:  16,
+	}
+	placeholder, err := MakePlaceholderMagick(src.Bytes(), params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if placeholder.DominantColor != "#ff0000" || placeholder.AverageColor != "#ff0000" {
+		t.Errorf("unexpected colors %s, %s", placeholder.DominantColor, placeholder.AverageColor)
+	}
+	if len(placeholder.BlurHash) != 28 || placeholder.BlurHash[2:6] != encodeBase83(0xFF0000, 4) {
+		t.Errorf("unexpected BlurHash %q", placeholder.BlurHash)
+	}
+	if !bytes.HasPrefix(placeholder.LQIP, []byte("RIFF")) {
+		t.Error("LQIP should be WebP")
+	}
+
+	params.LQIPSize = 0
+	if placeholder, err = MakePlaceholderMagick(src.Bytes(), params); err != nil || placeholder.LQIP != nil {
+		t.Errorf("LQIP should not be made, err %v", err)
+	}
+	params.BlurHashX = 10
+	if _, err = MakePlaceholderMagick(src.Bytes(), params); err != ErrInvalidBlurHashComponents {
+		t.Errorf("err = %v, want ErrInvalidBlurHashComponents", err)
+	}
+}
@@ -0,0 +1,118 @@
+package thumbnail
+
+import (
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+func filledImage(width, height int, fill func(x, y int) color.NRGBA) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetNRGBA(x, y, fill(x, y))
+		}
+	}
+	return img
+}
+
+func decodeBase83(s string) int {
+	value := 0
+	for i := 0; i < len(s); i++ {
+		value = value*83 + strings.IndexByte(base83Chars, s[i])
+	}
+	return value
+}
+
+func TestEncodeBase83(t *testing.T) {
+	cases := []struct {
+		value, length int
+		want          string
+	}{
+		{0, 1, "0"},
+		{82, 1, "~"},
+		{83, 2, "10"},
+		{0xFF0000, 4, "TI:j"},
+	}
+	for _, c := range cases {
+		if got := encodeBase83(c.value, c.length); got != c.want {
+			t.Errorf("encodeBase83(%d, %d) = %q, want %q", c.value, c.length, got, c.want)
+		}
+	}
+}
+
+func TestBlurHash(t *testing.T) {
+	red := filledImage(32, 24, func(x, y int) color.NRGBA { return color.NRGBA{255, 0, 0, 255} })
+	hash, err := blurHash(red, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 成分数、最大値、DC (#ff0000)
+	if hash != "00"+encodeBase83(0xFF0000, 4) {
+		t.Errorf("blurHash = %q", hash)
+	}
+
+	hash, err = blurHash(red, 4, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hash) != 4+2*4*3 || hash[0] != base83Chars[3+2*9] || hash[2:6] != encodeBase83(0xFF0000, 4) {
+		t.Errorf("unexpected hash: %q", hash)
+	}
+
+	// 左が黒、右が白なら、DC は灰色で、横の最初の成分は負 (右が明るい)
+	split := filledImage(32, 24, func(x, y int) color.NRGBA {
+		if x < 16 {
+			return color.NRGBA{0, 0, 0, 255}
+		}
+		return color.NRGBA{255, 255, 255, 255}
+	})
+	hash, err = blurHash(split, 4, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gray := linearToSRGB(0.5)
+	if hash[2:6] != encodeBase83(gray<<16|gray<<8|gray, 4) {
+		t.Errorf("DC should be gray: %q", hash)
+	}
+	if ac := decodeBase83(hash[6:8]); ac/(19*19) >= 9 || ac/(19*19) != ac%19 {
+		t.Errorf("the first horizontal component should be negative and gray: %q", hash)
+	}
+
+	if _, err := blurHash(red, 0, 3); err != ErrInvalidBlurHashComponents {
+		t.Errorf("err = %v, want ErrInvalidBlurHashComponents", err)
+	}
+	if _, err := blurHash(red, 10, 3); err != ErrInvalidBlurHashComponents {
+		t.Errorf("err = %v, want ErrInvalidBlurHashComponents", err)
+	}
+}
+
+func TestPlaceholderColors(t *testing.T) {
+	// 3/4 が青、1/4 が赤
+	img := filledImage(4, 4, func(x, y int) color.NRGBA {
+		if x == 0 {
+			return color.NRGBA{255, 0, 0, 255}
+		}
+		return color.NRGBA{0, 0, 255, 255}
+	})
+	dominant, average := placeholderColors(img)
+	if dominant != "#0000ff" || average != "#4000bf" {
+		t.Errorf("placeholderColors = %s, %s", dominant, average)
+	}
+
+	// 透明なピクセルは数えない
+	img = filledImage(4, 4, func(x, y int) color.NRGBA {
+		if x == 0 {
+			return color.NRGBA{0, 255, 0, 255}
+		}
+		return color.NRGBA{255, 0, 0, 0}
+	})
+	if dominant, average = placeholderColors(img); dominant != "#00ff00" || average != "#00ff00" {
+		t.Errorf("placeholderColors = %s, %s", dominant, average)
+	}
+
+	if dominant, average = placeholderColors(image.NewNRGBA(image.Rect(0, 0, 2, 2))); dominant != "" || average != "" {
+		t.Errorf("fully transparent image should have no color, got %s, %s", dominant, average)
+	}
+}
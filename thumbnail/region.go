@@ -0,0 +1,39 @@
+package thumbnail
+
+import (
+	"errors"
+	"math"
+)
+
+// ErrInvalidSourceRegion is returned when the source region is outside of the image.
+var ErrInvalidSourceRegion = errors.New("source region is out of the image")
+
+// SourceRegion is a rectangle of the source image to make the thumbnail from.
+// The zero value means the whole image.
+type SourceRegion struct {
+	X, Y, Width, Height float64
+	Ratio               bool // true なら元画像の横幅、縦幅に対する比率 (0〜1)
+}
+
+func (r SourceRegion) isSet() bool {
+	return r.Width != 0 || r.Height != 0
+}
+
+/*
+ * 元画像 (EXIF Orientation 適用後) のサイズから、領域をピクセル単位の x, y, 幅, 高さにする。
+ * 画像からはみ出す場合はエラーを返す。
+ */
+func (r SourceRegion) resolve(srcWidth, srcHeight float64) (x, y int, width, height uint, err error) {
+	left, top, right, bottom := r.X, r.Y, r.X+r.Width, r.Y+r.Height
+	if r.Ratio {
+		// 丸めで右端、下端がはみ出さないように、両端を変換してから幅を出す
+		left, right = left*srcWidth, right*srcWidth
+		top, bottom = top*srcHeight, bottom*srcHeight
+	}
+	left, top = math.Floor(left+.5), math.Floor(top+.5)
+	right, bottom = math.Floor(right+.5), math.Floor(bottom+.5)
+	if left < 0 || top < 0 || right <= left || bottom <= top || right > srcWidth || bottom > srcHeight {
+		return 0, 0, 0, 0, ErrInvalidSourceRegion
+	}
+	return int(left), int(top), uint(right - left), uint(bottom - top), nil
+}
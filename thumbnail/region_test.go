@@ -0,0 +1,96 @@
+package thumbnail
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSourceRegionResolve(t *testing.T) {
+	cases := []struct {
+		region        SourceRegion
+		x, y          int
+		width, height uint
+		ok            bool
+	}{
+		{SourceRegion{X: 10, Y: 20, Width: 80, Height: 50}, 10, 20, 80, 50, true},
+		{SourceRegion{X: 0, Y: 0, Width: 101, Height: 101}, 0, 0, 101, 101, true},
+		{SourceRegion{X: 1, Y: 0, Width: 101, Height: 101}, 0, 0, 0, 0, false},
+		{SourceRegion{X: 0, Y: 100, Width: 10, Height: 10}, 0, 0, 0, 0, false},
+		// 比率の場合は右端、下端がはみ出さないように丸める
+		{SourceRegion{X: 0.5, Y: 0, Width: 0.5, Height: 1, Ratio: true}, 51, 0, 50, 101, true},
+		{SourceRegion{X: 0.25, Y: 0.25, Width: 0.5, Height: 0.5, Ratio: true}, 25, 25, 51, 51, true},
+		{SourceRegion{X: 0.5, Y: 0, Width: 0.6, Height: 1, Ratio: true}, 0, 0, 0, 0, false},
+	}
+	for _, c := range cases {
+		x, y, width, height, err := c.region.resolve(101, 101)
+		if (err == nil) != c.ok {
+			t.Errorf("%+v: err = %v", c.region, err)
+			continue
+		}
+		if x != c.x || y != c.y || width != c.width || height != c.height {
+			t.Errorf("%+v: resolve = (%d, %d, %d, %d), want (%d, %d, %d, %d)",
+				c.region, x, y, width, height, c.x, c.y, c.width, c.height)
+		}
+	}
+}
+
+func TestSourceRegion(t *testing.T) {
+	// 左半分が赤、右半分が青の 300x100 の画像
+	img := image.NewRGBA(image.Rect(0, 0, 300, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 300; x++ {
+			if x < 150 {
+				img.Set(x, y, color.RGBA{255, 0, 0, 255})
+			} else {
+				img.Set(x, y, color.RGBA{0, 0, 255, 255})
+			}
+		}
+	}
+	var src bytes.Buffer
+	if err := png.Encode(&src, img); err != nil {
+		t.Fatal(err)
+	}
+
+	params := ThumbnailParameters{
+		Width:        50,
+		Height:       50,
+		Quality:      90,
+		Gravity:      5,
+		CropMode:     1,
+		Background:   "white",
+		FormatOutput: "png",
+		MaxPixels:    1000000,
+		CropDebug:    true,
+		SourceRegion: SourceRegion{X: 0.5, Y: 0, Width: 0.5, Height: 1, Ratio: true},
+	}
+	rec := httptest.NewRecorder()
+	if err := MakeThumbnailMagick(src.Bytes(), rec, params); err != nil {
+		t.Fatal(err)
+	}
+	// クロップの計算は領域 (150x100) を元画像として行う
+	if got := rec.Header().Get("X-Thumber-Crop"); got != "25,0,100,100" {
+		t.Errorf("X-Thumber-Crop = %q, want %q", got, "25,0,100,100")
+	}
+	out, err := png.Decode(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Bounds().Dx() != 50 || out.Bounds().Dy() != 50 {
+		t.Errorf("size = %v, want 50x50", out.Bounds().Size())
+	}
+	for _, p := range []image.Point{{0, 25}, {49, 25}} {
+		r, _, b, _ := out.At(p.X, p.Y).RGBA()
+		if r>>8 > 8 || b>>8 < 247 {
+			t.Errorf("pixel at %v should be blue, got %v", p, out.At(p.X, p.Y))
+		}
+	}
+
+	params.SourceRegion = SourceRegion{X: 200, Y: 0, Width: 200, Height: 100}
+	if err := MakeThumbnailMagick(src.Bytes(), httptest.NewRecorder(), params); err != ErrInvalidSourceRegion {
+		t.Errorf("region out of the image: err = %v, want ErrInvalidSourceRegion", err)
+	}
+}
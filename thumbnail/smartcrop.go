@@ -0,0 +1,130 @@
+package thumbnail
+
+import (
+	"math"
+)
+
+/*
+ * スマートクロップ (cm=3) の解析処理
+ * 画素毎の注目度 (エッジの強さ、肌色、彩度) を求めて、その合計が最大になるクロップ位置を選ぶ。
+ * 乱数などは使わないので、同じ入力には常に同じ結果を返す。
+ */
+
+// 注目度の重み
+const (
+	saliencyEdgeWeight       = 1.0
+	saliencySkinWeight       = 1.8
+	saliencySaturationWeight = 0.3
+)
+
+// isSkinColor is the RGB skin color rule of Kovac et al. (uniform daylight).
+func isSkinColor(r, g, b int) bool {
+	max := r
+	if g > max {
+		max = g
+	}
+	if b > max {
+		max = b
+	}
+	min := r
+	if g < min {
+		min = g
+	}
+	if b < min {
+		min = b
+	}
+	return r > 95 && g > 40 && b > 20 && max-min > 15 &&
+		(r-g > 15 || g-r > 15) && r > g && r > b
+}
+
+/*
+ * pix (RGB 各 8bit を並べたもの) から画素毎の注目度を計算する
+ */
+func saliencyMap(pix []byte, width, height int) []float64 {
+	lum := make([]float64, width*height)
+	for i := range lum {
+		r, g, b := float64(pix[i*3]), float64(pix[i*3+1]), float64(pix[i*3+2])
+		lum[i] = (0.299*r + 0.587*g + 0.114*b) / 255
+	}
+	// 範囲外は端の画素で補う
+	at := func(x, y int) float64 {
+		if x < 0 {
+			x = 0
+		} else if x >= width {
+			x = width - 1
+		}
+		if y < 0 {
+			y = 0
+		} else if y >= height {
+			y = height - 1
+		}
+		return lum[y*width+x]
+	}
+
+	saliency := make([]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := y*width + x
+
+			// Sobel フィルタによるエッジの強さ
+			gx := at(x+1, y-1) + 2*at(x+1, y) + at(x+1, y+1) - at(x-1, y-1) - 2*at(x-1, y) - at(x-1, y+1)
+			gy := at(x-1, y+1) + 2*at(x, y+1) + at(x+1, y+1) - at(x-1, y-1) - 2*at(x, y-1) - at(x+1, y-1)
+			edge := math.Min(1, math.Sqrt(gx*gx+gy*gy)/4)
+
+			r, g, b := int(pix[i*3]), int(pix[i*3+1]), int(pix[i*3+2])
+			skin := 0.0
+			if isSkinColor(r, g, b) {
+				skin = 1
+			}
+
+			// 暗い画素の彩度は当てにならないので数えない
+			saturation := 0.0
+			max := math.Max(float64(r), math.Max(float64(g), float64(b)))
+			min := math.Min(float64(r), math.Min(float64(g), float64(b)))
+			if max > 0 && lum[i] > 0.1 {
+				saturation = (max - min) / max
+			}
+
+			saliency[i] = saliencyEdgeWeight*edge + saliencySkinWeight*skin + saliencySaturationWeight*saturation
+		}
+	}
+	return saliency
+}
+
+/*
+ * 注目度の合計が最大になる cropWidth x cropHeight の位置を返す。
+ * 同点の場合は中央に近い方を選ぶ。(一様な画像では中央でクロップする)
+ */
+func bestCropWindow(saliency []float64, width, height, cropWidth, cropHeight int) (int, int) {
+	// 積分画像 (summed-area table)
+	stride := width + 1
+	sat := make([]float64, stride*(height+1))
+	for y := 0; y < height; y++ {
+		rowSum := 0.0
+		for x := 0; x < width; x++ {
+			rowSum += saliency[y*width+x]
+			sat[(y+1)*stride+x+1] = sat[y*stride+x+1] + rowSum
+		}
+	}
+
+	centerX := float64(width-cropWidth) / 2
+	centerY := float64(height-cropHeight) / 2
+	bestX, bestY := 0, 0
+	bestScore := math.Inf(-1)
+	bestDistance := math.Inf(1)
+	for y := 0; y+cropHeight <= height; y++ {
+		for x := 0; x+cropWidth <= width; x++ {
+			score := sat[(y+cropHeight)*stride+x+cropWidth] - sat[y*stride+x+cropWidth] -
+				sat[(y+cropHeight)*stride+x] + sat[y*stride+x]
+			distance := math.Hypot(float64(x)-centerX, float64(y)-centerY)
+			// 積分画像の丸め誤差は同点とみなす
+			epsilon := 1e-9 * math.Max(1, math.Abs(bestScore))
+			if score > bestScore+epsilon || (score >= bestScore-epsilon && distance < bestDistance) {
+				bestX, bestY = x, y
+				bestScore = score
+				bestDistance = distance
+			}
+		}
+	}
+	return bestX, bestY
+}
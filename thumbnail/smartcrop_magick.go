@@ -0,0 +1,76 @@
+package thumbnail
+
+import (
+	"errors"
+	"math"
+
+	"github.com/golang/glog"
+	"gopkg.in/gographics/imagick.v2/imagick"
+)
+
+// 解析用に縮小する長辺のサイズ
+const smartCropAnalysisSize = 128
+
+/*
+ * スマートクロップの位置を画像の内容から決める。
+ * 解析は縮小した画像で行い、結果を元の画像の座標に戻す。
+ */
+func smartCropGeometry(mw *imagick.MagickWand, cropWidth, cropHeight float64) (cropX, cropY uint, err error) {
+	width := float64(mw.GetImageWidth())
+	height := float64(mw.GetImageHeight())
+	if cropWidth >= width && cropHeight >= height {
+		return 0, 0, nil
+	}
+
+	scale := math.Min(1, smartCropAnalysisSize/math.Max(width, height))
+	analysisWidth := uint(math.Max(1, math.Floor(width*scale+.5)))
+	analysisHeight := uint(math.Max(1, math.Floor(height*scale+.5)))
+
+	small := mw.GetImage()
+	defer small.Destroy()
+	err = small.ResizeImage(analysisWidth, analysisHeight, imagick.FILTER_BOX, 1)
+	if err != nil {
+		glog.Error("smart crop ResizeImage failed: " + err.Error())
+		return 0, 0, err
+	}
+	pixels, err := small.ExportImagePixels(0, 0, analysisWidth, analysisHeight, "RGB", imagick.PIXEL_CHAR)
+	if err != nil {
+		glog.Error("smart crop ExportImagePixels failed: " + err.Error())
+		return 0, 0, err
+	}
+	pix, ok := pixels.([]byte)
+	if !ok || len(pix) < int(analysisWidth*analysisHeight*3) {
+		return 0, 0, errors.New("smart crop: unexpected pixel data")
+	}
+
+	// 縮小時の丸めがあるので、縦横それぞれの倍率で変換する
+	scaleX := float64(analysisWidth) / width
+	scaleY := float64(analysisHeight) / height
+	windowWidth := clampInt(roundInt(cropWidth*scaleX), 1, int(analysisWidth))
+	windowHeight := clampInt(roundInt(cropHeight*scaleY), 1, int(analysisHeight))
+
+	x, y := bestCropWindow(saliencyMap(pix, int(analysisWidth), int(analysisHeight)),
+		int(analysisWidth), int(analysisHeight), windowWidth, windowHeight)
+
+	// 解析画像での可動範囲を元の画像の可動範囲に対応させる (端は端に移す)
+	cropX = mapCropOffset(x, int(analysisWidth)-windowWidth, width-cropWidth)
+	cropY = mapCropOffset(y, int(analysisHeight)-windowHeight, height-cropHeight)
+	return cropX, cropY, nil
+}
+
+func mapCropOffset(offset, analysisRange int, srcRange float64) uint {
+	if analysisRange <= 0 || srcRange <= 0 {
+		return 0
+	}
+	return round(float64(offset) / float64(analysisRange) * srcRange)
+}
+
+func clampInt(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
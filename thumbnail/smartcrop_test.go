@@ -0,0 +1,126 @@
+package thumbnail
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http/httptest"
+	"testing"
+)
+
+// rgbImage returns RGB pixels of a width x height gray image with a colored block.
+func rgbImage(width, height int, block image.Rectangle, c color.RGBA) []byte {
+	pix := make([]byte, width*height*3)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := (y*width + x) * 3
+			if (image.Point{x, y}).In(block) {
+				pix[i], pix[i+1], pix[i+2] = c.R, c.G, c.B
+			} else {
+				pix[i], pix[i+1], pix[i+2] = 128, 128, 128
+			}
+		}
+	}
+	return pix
+}
+
+var skinColor = color.RGBA{224, 172, 140, 255}
+
+func TestBestCropWindow(t *testing.T) {
+	cases := []struct {
+		name          string
+		width, height int
+		block         image.Rectangle
+		c             color.RGBA
+		cropW, cropH  int
+		x, y          int
+	}{
+		// 一様な画像は中央
+		{"uniform", 40, 10, image.Rect(0, 0, 0, 0), skinColor, 10, 10, 15, 0},
+		// 右端の肌色の領域を (境界のエッジも含めて) 囲む
+		{"skin", 40, 10, image.Rect(30, 0, 38, 10), skinColor, 10, 10, 29, 0},
+		// 上端の彩度の高い領域
+		{"saturation", 10, 40, image.Rect(0, 2, 10, 8), color.RGBA{20, 60, 220, 255}, 10, 10, 0, 1},
+	}
+	for _, c := range cases {
+		pix := rgbImage(c.width, c.height, c.block, c.c)
+		x, y := bestCropWindow(saliencyMap(pix, c.width, c.height), c.width, c.height, c.cropW, c.cropH)
+		if x != c.x || y != c.y {
+			t.Errorf("%s: bestCropWindow = (%d, %d), want (%d, %d)", c.name, x, y, c.x, c.y)
+		}
+	}
+}
+
+func TestSmartCrop(t *testing.T) {
+	// 300x100 の灰色の画像の右端に肌色の円
+	img := image.NewRGBA(image.Rect(0, 0, 300, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 300; x++ {
+			img.Set(x, y, color.RGBA{128, 128, 128, 255})
+			if dx, dy := x-250, y-50; dx*dx+dy*dy < 30*30 {
+				img.Set(x, y, skinColor)
+			}
+		}
+	}
+	var src bytes.Buffer
+	if err := png.Encode(&src, img); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		cropMode int
+		cal      float64
+		want     image.Rectangle // 中央クロップの場合は矩形そのもの、スマートクロップの場合は含むべき領域
+	}{
+		{1, 0, image.Rect(100, 0, 200, 100)},
+		{3, 0, image.Rect(220, 20, 280, 80)},
+		// クロップ面積制限で幅が広がっても、円を含む
+		{3, 0.5, image.Rect(220, 20, 280, 80)},
+	}
+	for _, c := range cases {
+		name := fmt.Sprintf("cm=%d,cal=%g", c.cropMode, c.cal)
+		params := ThumbnailParameters{
+			Width:              100,
+			Height:             100,
+			Quality:            90,
+			Gravity:            5,
+			CropMode:           c.cropMode,
+			CropAreaLimitation: c.cal,
+			Background:         "white",
+			FormatOutput:       "png",
+			MaxPixels:          1000000,
+			CropDebug:          true,
+		}
+		var headers []string
+		for i := 0; i < 2; i++ {
+			rec := httptest.NewRecorder()
+			if err := MakeThumbnailMagick(src.Bytes(), rec, params); err != nil {
+				t.Fatal(name, err)
+			}
+			headers = append(headers, rec.Header().Get("X-Thumber-Crop"))
+		}
+		if headers[0] != headers[1] {
+			t.Errorf("%s: not deterministic: %q, %q", name, headers[0], headers[1])
+		}
+
+		var x, y, w, h int
+		if _, err := fmt.Sscanf(headers[0], "%d,%d,%d,%d", &x, &y, &w, &h); err != nil {
+			t.Fatalf("%s: X-Thumber-Crop = %q", name, headers[0])
+		}
+		crop := image.Rect(x, y, x+w, y+h)
+		if !crop.In(img.Bounds()) {
+			t.Errorf("%s: crop %v is out of the image", name, crop)
+		}
+		if c.cropMode == 1 && crop != c.want {
+			t.Errorf("%s: crop = %v, want %v", name, crop, c.want)
+		}
+		if c.cropMode == 3 && !c.want.In(crop) {
+			t.Errorf("%s: crop %v should contain %v", name, crop, c.want)
+		}
+		if c.cal > 0 && w != 150 {
+			t.Errorf("%s: crop width = %d, want 150", name, w)
+		}
+	}
+}
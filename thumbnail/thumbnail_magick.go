@@ -10,6 +10,7 @@ import (
 	"math"
 	"net/http" // XXX
 	"strings"
+	"time"
 
 	"github.com/golang/glog"
 	"gopkg.in/gographics/imagick.v2/imagick"
@@ -37,13 +38,41 @@ type ThumbnailParameters struct {
 	TextFontSize            float64
 	TextGravity             int
 	TextMargin              int
-	CropMode                int
+	CropMode                int // 0:リサイズのみ 1:クロップ 2:マージン 3:スマートクロップ
 	Background              string
 	TextFont                []string
 	HttpAvoidChunk          bool
 	FormatOutput            string
 	CropAreaLimitation      float64
 	MaxPixels               uint
+	Animate                 bool         // アニメーションを維持するか
+	MaxAnimationPixels      uint         // フレーム数 x ピクセル数の上限
+	Timings                 *Timings     // 処理時間の記録先 (nil なら記録しない)
+	KeepProfiles            []string     // 削除せずに残すメタデータ (exif, xmp, iptc など)
+	EmbedProfile            bool         // 出力に sRGB の ICC プロファイルを埋め込むか
+	CMYKProfile             []byte       // プロファイルの無い CMYK 画像に使う ICC プロファイル (nil なら内蔵の FOGRA39)
+	CropDebug               bool         // クロップした矩形を X-Thumber-Crop、デコードした大きさを X-Thumber-Decode ヘッダで返す
+	FocalPoint              bool         // クロップ (cm=1) で Gravity の代わりに FocalX, FocalY を使う
+	FocalX                  float64      // 注目点の横位置 (0〜1)
+	FocalY                  float64      // 注目点の縦位置 (0〜1)
+	SourceRegion            SourceRegion // 元画像のこの領域だけを使う (ゼロ値なら全体)
+	BlurHashX               int          // プレースホルダの BlurHash の横の成分数 (1〜9)
+	BlurHashY               int          // プレースホルダの BlurHash の縦の成分数 (1〜9)
+	LQIPSize                int          // プレースホルダの LQIP の長辺のピクセル数 (0 なら作らない)
+}
+
+// Timings receives the time spent in each step of MakeThumbnailMagick
+type Timings struct {
+	Decode  time.Duration
+	Process time.Duration
+	Encode  time.Duration
+}
+
+// 区間の経過時間を記録して、次の区間の開始時刻を返す
+func recordTiming(d *time.Duration, start time.Time) time.Time {
+	now := time.Now()
+	*d = now.Sub(start)
+	return now
 }
 
 func round(f float64) uint {
@@ -54,6 +83,35 @@ func roundInt(f float64) int {
 	return int(math.Floor(f + .5))
 }
 
+/*
+ * 使う領域 (sc, クロップ) を出力サイズにするための縮小率。1 以上なら縮小しない。
+ */
+func decodeScale(cropMode int, srcWidth, srcHeight, cropWidth, cropHeight, destWidth, destHeight, mappedWidth, mappedHeight float64) float64 {
+	var scaleX, scaleY float64
+	switch cropMode {
+	case 1, 3:
+		scaleX, scaleY = destWidth/cropWidth, destHeight/cropHeight
+	case 2:
+		scaleX, scaleY = mappedWidth/srcWidth, mappedHeight/srcHeight
+	default:
+		scaleX, scaleY = destWidth/srcWidth, destHeight/srcHeight
+	}
+	return math.Max(scaleX, scaleY)
+}
+
+/*
+ * jpeg:size の値。libjpeg は指定より大きい範囲で 1/2〜1/8 に縮小してデコードする。
+ * リサイズの画質のため、必要な大きさの 2 倍を指定する。縮小しない場合は "" を返す。
+ */
+func jpegSizeHint(width, height uint, scale float64) string {
+	if scale*2 >= 1 {
+		return ""
+	}
+	hintWidth := math.Max(1, math.Ceil(float64(width)*scale*2))
+	hintHeight := math.Max(1, math.Ceil(float64(height)*scale*2))
+	return fmt.Sprintf("%dx%d", int(hintWidth), int(hintHeight))
+}
+
 /*
  * Cropモードの時の Gravity に応じたオフセット(X,Y)位置を計算する
  */
@@ -90,6 +148,16 @@ func getCropGeometry(srcAspect, destAspect, srcHeight, cropHeight, srcWidth, cro
 
 }
 
+/*
+ * Cropモードで注目点 (focalX, focalY は 0〜1 の比率) を中心にした時のオフセット(X,Y)位置を計算する
+ * クロップ範囲が画像からはみ出す場合は、画像の端に寄せる。
+ */
+func getFocalCropGeometry(srcWidth, srcHeight, cropWidth, cropHeight, focalX, focalY float64) (cropX, cropY uint) {
+	cropX = round(math.Max(0, math.Min(focalX*srcWidth-cropWidth/2, srcWidth-cropWidth)))
+	cropY = round(math.Max(0, math.Min(focalY*srcHeight-cropHeight/2, srcHeight-cropHeight)))
+	return
+}
+
 /*
  * Margin モードや画像上書き処理での Gravity に応じた X ratio を返す
  */
@@ -156,6 +224,10 @@ func isFormatTransparent(format string) bool {
 		return true
 	case "gif":
 		return true
+	case "avif":
+		return true
+	case "jxl":
+		return true
 	}
 	return false
 }
@@ -171,6 +243,63 @@ func isOutputTransparent(inputFormat, outputFormat string) bool {
 	return false
 }
 
+/*
+ * EXIF Orientation 5〜8 は縦横が入れ替わる
+ */
+func isOrientationTransposed(orientation imagick.OrientationType) bool {
+	switch orientation {
+	case imagick.ORIENTATION_LEFT_TOP, imagick.ORIENTATION_RIGHT_TOP,
+		imagick.ORIENTATION_RIGHT_BOTTOM, imagick.ORIENTATION_LEFT_BOTTOM:
+		return true
+	}
+	return false
+}
+
+/*
+ * メタデータの削除
+ * 位置情報などを公開しないように、keep で指定されたもの以外の EXIF, XMP, IPTC などを落とす。
+ * ICC プロファイルは convertToSRGB で扱うので、ここでは残す。
+ */
+func stripProfiles(mw *imagick.MagickWand, keep []string) {
+	for _, name := range mw.GetImageProfiles("*") {
+		name = strings.ToLower(name)
+		if name == "icc" || name == "icm" {
+			continue
+		}
+		kept := false
+		for _, k := range keep {
+			if strings.ToLower(k) == name {
+				kept = true
+				break
+			}
+		}
+		if !kept {
+			mw.RemoveImageProfile(name)
+		}
+	}
+}
+
+/*
+ * 出力フォーマットの指定が無い場合は入力フォーマットを返す
+ */
+func getOutputFormat(inputFormat, outputFormat string) string {
+	if outputFormat == "" {
+		return strings.ToLower(inputFormat)
+	}
+	return strings.ToLower(outputFormat)
+}
+
+func isFormatAnimatable(format string) bool {
+	format = strings.ToLower(format)
+	switch format {
+	case "gif":
+		return true
+	case "webp":
+		return true
+	}
+	return false
+}
+
 // This function comes from yoya san's gist. For more details, see: https://gist.github.com/yoya/2ae952716dbf70bc749181781eda27a8
 func extractGIF1stFrame(bytes []byte) (int, error) {
 	size := len(bytes)
@@ -277,6 +406,12 @@ func init() {
  */
 func MakeThumbnailMagick(bytes []byte, dst http.ResponseWriter, params ThumbnailParameters) error {
 
+	timings := params.Timings
+	if timings == nil {
+		timings = &Timings{}
+	}
+	phaseStart := time.Now()
+
 	// var err error
 	var mw *imagick.MagickWand
 
@@ -295,7 +430,32 @@ func MakeThumbnailMagick(bytes []byte, dst http.ResponseWriter, params Thumbnail
 	srcWidth := float64(mw.GetImageWidth())
 	srcHeight := float64(mw.GetImageHeight())
 
-	if mw.GetImageFormat() == "GIF" {
+	// EXIF Orientation で 90度回転する場合は、回転後の縦横サイズで計算する
+	orientation := mw.GetImageOrientation()
+	if isOrientationTransposed(orientation) {
+		srcWidth, srcHeight = srcHeight, srcWidth
+	}
+
+	// 元画像の領域指定 (以降の計算では、この領域を元画像として扱う)
+	var regionX, regionY int
+	var regionWidth, regionHeight uint
+	if params.SourceRegion.isSet() {
+		regionX, regionY, regionWidth, regionHeight, err = params.SourceRegion.resolve(srcWidth, srcHeight)
+		if err != nil {
+			glog.Error(err.Error())
+			log.Println(err.Error())
+			return err
+		}
+		srcWidth = float64(regionWidth)
+		srcHeight = float64(regionHeight)
+	}
+
+	// アニメーションを維持するか (出力フォーマットがアニメーション対応の場合のみ)
+	numFrames := mw.GetNumberImages()
+	animate := params.Animate && numFrames > 1 &&
+		isFormatAnimatable(getOutputFormat(mw.GetImageFormat(), params.FormatOutput))
+
+	if mw.GetImageFormat() == "GIF" && !animate {
 		_, err := extractGIF1stFrame(bytes)
 		if err != nil {
 			glog.Error("extractGIF1stFrame failed" + err.Error())
@@ -310,6 +470,13 @@ func MakeThumbnailMagick(bytes []byte, dst http.ResponseWriter, params Thumbnail
 		return errors.New("origin image size too big, exceed max pixel num")
 	}
 
+	// decompression bomb 対策 (フレーム数 x ピクセル数)
+	if animate && uint(pixelNum)*numFrames > params.MaxAnimationPixels {
+		glog.Error("origin animation too big, exceed max animation pixel num")
+		log.Println("origin animation too big, exceed max animation pixel num")
+		return errors.New("origin animation too big, exceed max animation pixel num")
+	}
+
 	var cropX uint = 0
 	var cropY uint = 0
 	var cropWidth float64 = 0
@@ -337,8 +504,6 @@ func MakeThumbnailMagick(bytes []byte, dst http.ResponseWriter, params Thumbnail
 	var mappedY uint = 0
 	var mappedWidth float64 = float64(destWidth)
 	var mappedHeight float64 = float64(destHeight)
-	var virtualMappedWidth float64 = float64(destWidth)
-	var virtualMappedHeight float64 = float64(destHeight)
 
 	/*
 	 * リサイズの計算。(クロップ方式、マージン方式)
@@ -364,9 +529,7 @@ func MakeThumbnailMagick(bytes []byte, dst http.ResponseWriter, params Thumbnail
 			mappedWidth = destWidth
 			mappedHeight = destHeight
 		}
-		virtualMappedWidth = destWidth
-		virtualMappedHeight = destHeight
-	} else if params.CropMode == 1 {
+	} else if params.CropMode == 1 || params.CropMode == 3 {
 		// クロップする
 
 		// 横と縦、両方の辺が元より大きい場合は、リサイズしない
@@ -403,7 +566,11 @@ func MakeThumbnailMagick(bytes []byte, dst http.ResponseWriter, params Thumbnail
 				}
 			}
 
-			if params.Gravity == 0 {
+			if params.CropMode == 3 {
+				// クロップ位置はデコード後に画像の内容から決める (smartCropGeometry)
+			} else if params.FocalPoint {
+				cropX, cropY = getFocalCropGeometry(srcWidth, srcHeight, cropWidth, cropHeight, params.FocalX, params.FocalY)
+			} else if params.Gravity == 0 {
 				glog.Error("cropmode=1 & gravity = 0 is invalid condition")
 				log.Println("cropmode=1 & gravity = 0 is invalid condition")
 				return nil
@@ -411,8 +578,6 @@ func MakeThumbnailMagick(bytes []byte, dst http.ResponseWriter, params Thumbnail
 				cropX, cropY = getCropGeometry(srcAspect, destAspect, srcHeight, cropHeight, srcWidth, cropWidth, params.Gravity)
 			}
 		}
-		virtualMappedWidth = srcWidth
-		virtualMappedHeight = destWidth
 	} else if params.CropMode == 2 {
 		// 余白をつける (マージン方式)
 		// 横と縦、両方の辺が元より大きい場合は、リサイズしない
@@ -436,8 +601,6 @@ func MakeThumbnailMagick(bytes []byte, dst http.ResponseWriter, params Thumbnail
 
 		mappedX = round((destWidth - mappedWidth) * getHorizontal(params.Gravity))
 		mappedY = round((destHeight - mappedHeight) * getVertical(params.Gravity))
-		virtualMappedWidth = mappedWidth
-		virtualMappedHeight = mappedHeight
 	} else {
 		glog.Error("Invalie CropMode:%d", params.CropMode)
 		log.Printf("Invalie CropMode:%d", params.CropMode)
@@ -445,15 +608,17 @@ func MakeThumbnailMagick(bytes []byte, dst http.ResponseWriter, params Thumbnail
 	}
 
 	// JPEG scaling decode hinting
-	if virtualMappedWidth < srcWidth/2 && virtualMappedHeight < srcHeight/2 {
-		jpegSize := fmt.Sprintf("%dx%d", roundInt(virtualMappedWidth*2), roundInt(virtualMappedHeight*2))
-		mw.SetOption("jpeg:size", jpegSize)
-	}
+	// 使う領域 (sc, クロップ) を出力サイズにするのに必要な縮小率から、デコードする大きさを決める
+	pingWidth, pingHeight := mw.GetImageWidth(), mw.GetImageHeight()
+	jpegSize := jpegSizeHint(pingWidth, pingHeight, decodeScale(params.CropMode, srcWidth, srcHeight, cropWidth, cropHeight, destWidth, destHeight, mappedWidth, mappedHeight))
 
 	// Decode Image
 	mw = imagick.NewMagickWand()
 	defer mw.Destroy()
 	mw.SetResourceLimit(imagick.RESOURCE_THREAD, 1)
+	if jpegSize != "" {
+		mw.SetOption("jpeg:size", jpegSize)
+	}
 
 	err = mw.ReadImageBlob(bytes)
 	if err != nil {
@@ -464,65 +629,54 @@ func MakeThumbnailMagick(bytes []byte, dst http.ResponseWriter, params Thumbnail
 
 	mw.SetFirstIterator()
 
-	for mw.GetNumberImages() > 1 {
-		mw.NextImage()
-		mw.RemoveImage()
-		mw.SetFirstIterator()
+	// 縮小してデコードされた場合の、元画像 (EXIF Orientation 適用後) の座標からデコード後の座標への比率
+	decodedWidth, decodedHeight := mw.GetImageWidth(), mw.GetImageHeight()
+	scaleX := float64(decodedWidth) / float64(pingWidth)
+	scaleY := float64(decodedHeight) / float64(pingHeight)
+	if isOrientationTransposed(orientation) {
+		scaleX, scaleY = scaleY, scaleX
 	}
 
-	if !isOutputTransparent(mw.GetImageFormat(), params.FormatOutput) &&
-		len(params.Background) == 9 && params.Background[0] == '#' {
-		params.Background = params.Background[0:7]
-	}
-
-	/*
-	 * 画像のリサイズ処理。(クロップ方式、マージン方式)
-	 */
-	if params.CropMode == 0 {
-		// リサイズのみ。クロップもマージンも無し
-		err = mw.ResizeImage(round(destWidth), round(destHeight), imagick.FILTER_UNDEFINED, 1)
-		if err != nil {
-			glog.Error("Upstream ResizeImage failed: " + err.Error())
-			log.Println("Upstream ResizeImage failed: " + err.Error())
-			return err
+	if animate {
+		// Ping で数えたフレーム数と実際のフレーム数が異なる場合に備えて再確認する
+		if uint(pixelNum)*mw.GetNumberImages() > params.MaxAnimationPixels {
+			glog.Error("origin animation too big, exceed max animation pixel num")
+			log.Println("origin animation too big, exceed max animation pixel num")
+			return errors.New("origin animation too big, exceed max animation pixel num")
 		}
-	} else if params.CropMode == 1 {
-		// クロップとリサイズを同時に行う
-		// fmt.Printf("TransformImage:  cropX:%d cropY:%d cropWidth:%f, cropHeight:%f destWidth:%f, destHeight:%f\n", cropX, cropY, cropWidth, cropHeight, destWidth, destHeight)
-		geoSrc := fmt.Sprintf("%dx%d+%d+%d", round(cropWidth), round(cropHeight), cropX, cropY)
-		geoDest := fmt.Sprintf("%dx%d!", round(destWidth), round(destHeight))
-		//		fmt.Println("geo_src, geo_dest: ", geo_src, geo_dest)
-		mw2 := mw.TransformImage(geoSrc, geoDest)
-		defer mw2.Destroy()
-		err := mw2.GetLastError()
+		// 差分フレームをキャンバス全体のフレームに展開する
+		coalesced := mw.CoalesceImages()
+		defer coalesced.Destroy()
+		err = coalesced.GetLastError()
 		if err != nil {
-			glog.Error("TransformImage failed")
-			log.Println("TransformImage failed")
+			glog.Error("CoalesceImages failed: " + err.Error())
+			log.Println("CoalesceImages failed: " + err.Error())
 			return err
 		}
-		mw = mw2
-		mw.ResetImagePage("") // +repage
-	} else if params.CropMode == 2 {
-		// 余白をつける (マージン方式)
-		pw := imagick.NewPixelWand()
-		defer pw.Destroy()
+		mw = coalesced
+	} else {
+		for mw.GetNumberImages() > 1 {
+			mw.NextImage()
+			mw.RemoveImage()
+			mw.SetFirstIterator()
+		}
+	}
 
-		pw.SetColor(params.Background)
-		mw.SetImageBackgroundColor(pw) // 余白の色
+	phaseStart = recordTiming(&timings.Decode, phaseStart)
 
-		err = mw.ResizeImage(round(mappedWidth), round(mappedHeight), imagick.FILTER_UNDEFINED, 1)
-		if err != nil {
-			glog.Error("Upstream ResizeImage failed: " + err.Error())
-			log.Println("Upstream ResizeImage failed: " + err.Error())
-			return err
-		}
+	if !isOutputTransparent(mw.GetImageFormat(), params.FormatOutput) &&
+		len(params.Background) == 9 && params.Background[0] == '#' {
+		params.Background = params.Background[0:7]
 	}
+
 	/*
-	 * 上書き画像の処理
+	 * 上書き画像の準備
 	 */
+	var mwc *imagick.MagickWand
+	var iox, ioy int
 	if params.ImageOverlap != nil {
 
-		mwc := imagick.NewMagickWand()
+		mwc = imagick.NewMagickWand()
 		defer mwc.Destroy()
 
 		mwc.SetResourceLimit(imagick.RESOURCE_THREAD, 1)
@@ -567,7 +721,6 @@ func MakeThumbnailMagick(bytes []byte, dst http.ResponseWriter, params Thumbnail
 		imageOverlapHeight = round(yScaleFactor * srcOverlapHeight)
 
 		// 上書きする位置を計算する
-		var iox, ioy int
 		var xRatio float64 = params.ImageOverlapXRatio
 		var yRatio float64 = params.ImageOverlapYRatio
 		if params.ImageOverlapGravity != 0 { // gravityを指定されている場合
@@ -587,14 +740,14 @@ func MakeThumbnailMagick(bytes []byte, dst http.ResponseWriter, params Thumbnail
 		mwc.ResizeImage(imageOverlapWidth, imageOverlapHeight, imagick.FILTER_UNDEFINED, 1)
 
 		mwc.SetImageMatte(true) // 透明度を有効にする
-		mw.CompositeImage(mwc, imagick.COMPOSITE_OP_OVER, iox, ioy)
 	}
 
 	/*
-	 *  アノテーション。(文字列を上書きする)
+	 *  アノテーションの準備。(文字列を上書きする)
 	 */
+	var dw *imagick.DrawingWand
 	if params.Text != "" {
-		dw := imagick.NewDrawingWand()
+		dw = imagick.NewDrawingWand()
 		defer dw.Destroy()
 		var japanese_font_list []string = nil
 		if len(params.TextFont) > 0 {
@@ -662,46 +815,221 @@ func MakeThumbnailMagick(bytes []byte, dst http.ResponseWriter, params Thumbnail
 
 		dw.SetFillColor(cw)
 		dw.Annotation(textX, textY, params.Text)
+	}
 
-		mw.DrawImage(dw)
+	smartCropped := false
 
-	}
+	/*
+	 * 1フレーム分の加工処理。
+	 * 引数の frame は呼び出し側で Destroy する。返り値が frame と異なる場合は、それも呼び出し側で Destroy する。
+	 */
+	processFrame := func(frame *imagick.MagickWand) (result *imagick.MagickWand, err error) {
+		mw := frame
+		// 途中で作った wand (TransformImage の結果) は、返さない場合にここで Destroy する
+		defer func() {
+			if mw != frame && mw != result {
+				mw.Destroy()
+			}
+		}()
+
+		// EXIF Orientation に従って回転する
+		if orientation != imagick.ORIENTATION_UNDEFINED && orientation != imagick.ORIENTATION_TOP_LEFT {
+			err := mw.AutoOrientImage()
+			if err != nil {
+				glog.Error("AutoOrientImage failed: " + err.Error())
+				log.Println("AutoOrientImage failed: " + err.Error())
+				return nil, err
+			}
+		}
 
-	// 座標情報をResetImagePageで落とす
-	err = mw.ResetImagePage("")
-	if err != nil {
-		glog.Error("Upstream ResetImagePage failed: " + err.Error())
-		log.Println("Upstream ResetImagePage failed: " + err.Error())
-		return err
-	}
+		// 元画像の領域指定
+		if params.SourceRegion.isSet() {
+			err := mw.CropImage(round(float64(regionWidth)*scaleX), round(float64(regionHeight)*scaleY),
+				roundInt(float64(regionX)*scaleX), roundInt(float64(regionY)*scaleY))
+			if err != nil {
+				glog.Error("CropImage failed: " + err.Error())
+				log.Println("CropImage failed: " + err.Error())
+				return nil, err
+			}
+			mw.ResetImagePage("") // +repage
+		}
+
+		// リサイズ前に sRGB に揃える
+		if err := convertToSRGB(mw, params.CMYKProfile, params.EmbedProfile); err != nil {
+			log.Println("convertToSRGB failed: " + err.Error())
+			return nil, err
+		}
+
+		// スマートクロップの位置は最初のフレームで決めて、全てのフレームに使う
+		if params.CropMode == 3 && !smartCropped {
+			x, y, err := smartCropGeometry(mw, cropWidth*scaleX, cropHeight*scaleY)
+			if err != nil {
+				log.Println("smartCropGeometry failed: " + err.Error())
+				return nil, err
+			}
+			cropX, cropY = round(float64(x)/scaleX), round(float64(y)/scaleY)
+			smartCropped = true
+		}
+
+		/*
+		 * 画像のリサイズ処理。(クロップ方式、マージン方式)
+		 */
+		if params.CropMode == 0 {
+			// リサイズのみ。クロップもマージンも無し
+			err := mw.ResizeImage(round(destWidth), round(destHeight), imagick.FILTER_UNDEFINED, 1)
+			if err != nil {
+				glog.Error("Upstream ResizeImage failed: " + err.Error())
+				log.Println("Upstream ResizeImage failed: " + err.Error())
+				return nil, err
+			}
+		} else if params.CropMode == 1 || params.CropMode == 3 {
+			// クロップとリサイズを同時に行う
+			// fmt.Printf("TransformImage:  cropX:%d cropY:%d cropWidth:%f, cropHeight:%f destWidth:%f, destHeight:%f\n", cropX, cropY, cropWidth, cropHeight, destWidth, destHeight)
+			geoSrc := fmt.Sprintf("%dx%d+%d+%d", round(cropWidth*scaleX), round(cropHeight*scaleY),
+				round(float64(cropX)*scaleX), round(float64(cropY)*scaleY))
+			geoDest := fmt.Sprintf("%dx%d!", round(destWidth), round(destHeight))
+			//		fmt.Println("geo_src, geo_dest: ", geo_src, geo_dest)
+			mw2 := mw.TransformImage(geoSrc, geoDest)
+			err := mw2.GetLastError()
+			if err != nil {
+				mw2.Destroy()
+				glog.Error("TransformImage failed")
+				log.Println("TransformImage failed")
+				return nil, err
+			}
+			mw = mw2
+			mw.ResetImagePage("") // +repage
+		} else if params.CropMode == 2 {
+			// 余白をつける (マージン方式)
+			pw := imagick.NewPixelWand()
+			defer pw.Destroy()
+
+			pw.SetColor(params.Background)
+			mw.SetImageBackgroundColor(pw) // 余白の色
+
+			err := mw.ResizeImage(round(mappedWidth), round(mappedHeight), imagick.FILTER_UNDEFINED, 1)
+			if err != nil {
+				glog.Error("Upstream ResizeImage failed: " + err.Error())
+				log.Println("Upstream ResizeImage failed: " + err.Error())
+				return nil, err
+			}
+		}
+
+		// 上書き画像の合成
+		if mwc != nil {
+			mw.CompositeImage(mwc, imagick.COMPOSITE_OP_OVER, iox, ioy)
+		}
+
+		// アノテーションの描画
+		if dw != nil {
+			mw.DrawImage(dw)
+		}
 
-	if params.CropMode < 2 {
-		// 透明ピクセル背景色を適用する
-		pw := imagick.NewPixelWand()
-		defer pw.Destroy()
-		pw.SetColor(params.Background)
-		err := mw.SetImageBackgroundColor(pw) // 背景色の色
+		// 座標情報をResetImagePageで落とす
+		err = mw.ResetImagePage("")
 		if err != nil {
-			glog.Error("SetImageBackgroundColor failed: " + err.Error())
-			log.Println("SetImageBackgroundColor failed: " + err.Error())
-			return err
+			glog.Error("Upstream ResetImagePage failed: " + err.Error())
+			log.Println("Upstream ResetImagePage failed: " + err.Error())
+			return nil, err
 		}
-		// Flatten 処理
-		mw = mw.MergeImageLayers(imagick.IMAGE_LAYER_FLATTEN)
-		defer mw.Destroy()
-	} else { // params.CropMode == 2
+
+		if params.CropMode != 2 && animate {
+			// アニメーションは GIF/WebP で出力するので、フレームの透明度をそのまま残す
+			stripProfiles(mw, params.KeepProfiles)
+			return mw, nil
+		}
+		if params.CropMode != 2 {
+			// 透明ピクセル背景色を適用する
+			pw := imagick.NewPixelWand()
+			defer pw.Destroy()
+			pw.SetColor(params.Background)
+			err := mw.SetImageBackgroundColor(pw) // 背景色の色
+			if err != nil {
+				glog.Error("SetImageBackgroundColor failed: " + err.Error())
+				log.Println("SetImageBackgroundColor failed: " + err.Error())
+				return nil, err
+			}
+			// Flatten 処理
+			flattened := mw.MergeImageLayers(imagick.IMAGE_LAYER_FLATTEN)
+			stripProfiles(flattened, params.KeepProfiles)
+			return flattened, nil
+		}
+		// params.CropMode == 2
 		// マージン方式の時は縦横サイズを拡張する。
-		err := mw.ExtentImage(round(destWidth), round(destHeight), -int(mappedX), -int(mappedY))
+		err = mw.ExtentImage(round(destWidth), round(destHeight), -int(mappedX), -int(mappedY))
 		if err != nil {
-			panic(err)
+			glog.Error("Upstream ExtentImage failed: " + err.Error())
+			log.Println("Upstream ExtentImage failed: " + err.Error())
+			return nil, err
 		}
 		err = mw.ResetImagePage("") // +repage
 		if err != nil {
 			glog.Error("Upstream ResetImagePage failed: " + err.Error())
 			log.Println("Upstream ResetImagePage failed: " + err.Error())
+			return nil, err
+		}
+		stripProfiles(mw, params.KeepProfiles)
+		return mw, nil
+	}
+
+	if animate {
+		// フレーム毎に加工して、新しいシーケンスに積み直す
+		frames := imagick.NewMagickWand()
+		defer frames.Destroy()
+		for i := 0; i < int(mw.GetNumberImages()); i++ {
+			mw.SetIteratorIndex(i)
+			frame := mw.GetImage()
+			processed, err := processFrame(frame)
+			if err != nil {
+				frame.Destroy()
+				return err
+			}
+			// 表示時間とループ回数を引き継ぐ
+			processed.SetImageDelay(frame.GetImageDelay())
+			processed.SetImageTicksPerSecond(int(frame.GetImageTicksPerSecond()))
+			processed.SetImageIterations(frame.GetImageIterations())
+			processed.SetImageDispose(imagick.DISPOSE_BACKGROUND)
+			err = frames.AddImage(processed)
+			if processed != frame {
+				processed.Destroy()
+			}
+			frame.Destroy()
+			if err != nil {
+				glog.Error("AddImage failed: " + err.Error())
+				log.Println("AddImage failed: " + err.Error())
+				return err
+			}
+		}
+		mw = frames
+
+		if getOutputFormat(mw.GetImageFormat(), params.FormatOutput) == "gif" {
+			// GIF はフレーム間の差分だけを残してサイズを抑える
+			optimized := mw.OptimizeImageLayers()
+			defer optimized.Destroy()
+			err = optimized.GetLastError()
+			if err != nil {
+				glog.Error("OptimizeImageLayers failed: " + err.Error())
+				log.Println("OptimizeImageLayers failed: " + err.Error())
+				return err
+			}
+			mw = optimized
+		}
+	} else {
+		processed, err := processFrame(mw)
+		if err != nil {
 			return err
 		}
+		if processed != mw {
+			defer processed.Destroy()
+		}
+		mw = processed
 	}
+
+	phaseStart = recordTiming(&timings.Process, phaseStart)
+
+	// 出力フォーマットや画質は先頭フレームの設定が使われる
+	mw.SetFirstIterator()
+
 	// JPEG, WebP
 	err = mw.SetImageCompressionQuality(uint(params.Quality))
 	if err != nil {
@@ -724,6 +1052,10 @@ func MakeThumbnailMagick(bytes []byte, dst http.ResponseWriter, params Thumbnail
 		err = mw.SetImageFormat("gif")
 	case "heic", "heif":
 		err = mw.SetImageFormat("heic")
+	case "avif":
+		err = mw.SetImageFormat("avif")
+	case "jxl":
+		err = mw.SetImageFormat("jxl")
 	case "":
 		// nothing
 	}
@@ -736,11 +1068,12 @@ func MakeThumbnailMagick(bytes []byte, dst http.ResponseWriter, params Thumbnail
 
 	//画像出力
 	blob, err := mw.GetImagesBlob()
+	recordTiming(&timings.Encode, phaseStart)
 
 	if err != nil {
 		glog.Error("Get Images Blob failed: " + err.Error())
-        	log.Println("Get Images Blob failed: " + err.Error())
-        	return err
+		log.Println("Get Images Blob failed: " + err.Error())
+		return err
 	}
 
 	if len(blob) == 0 {
@@ -755,6 +1088,14 @@ func MakeThumbnailMagick(bytes []byte, dst http.ResponseWriter, params Thumbnail
 	if params.HttpAvoidChunk {
 		dst.Header().Set("Content-Length", fmt.Sprintf("%d", len(blob)))
 	}
+	if params.CropDebug && (params.CropMode == 1 || params.CropMode == 3) {
+		// 元画像 (EXIF Orientation 適用後) の座標での x,y,幅,高さ
+		dst.Header().Set("X-Thumber-Crop", fmt.Sprintf("%d,%d,%d,%d", cropX, cropY, round(cropWidth), round(cropHeight)))
+	}
+	if params.CropDebug {
+		// jpeg:size で縮小してデコードした大きさ (EXIF Orientation 適用前)
+		dst.Header().Set("X-Thumber-Decode", fmt.Sprintf("%dx%d", decodedWidth, decodedHeight))
+	}
 
 	dst.Write(blob)
 
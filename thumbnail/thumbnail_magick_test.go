@@ -0,0 +1,370 @@
+package thumbnail
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"gopkg.in/gographics/imagick.v2/imagick"
+)
+
+func TestGetFocalCropGeometry(t *testing.T) {
+	cases := []struct {
+		srcWidth, srcHeight, cropWidth, cropHeight float64
+		focalX, focalY                             float64
+		cropX, cropY                               uint
+	}{
+		{300, 100, 100, 100, 0.5, 0.5, 100, 0},
+		{300, 100, 100, 100, 0.3, 0.5, 40, 0},
+		// 画像の端に寄せる
+		{300, 100, 100, 100, 0, 0, 0, 0},
+		{300, 100, 100, 100, 0.9, 1, 200, 0},
+		{100, 300, 100, 100, 0.5, 0.8, 0, 190},
+		{100, 300, 100, 100, 0.5, 1, 0, 200},
+	}
+	for _, c := range cases {
+		x, y := getFocalCropGeometry(c.srcWidth, c.srcHeight, c.cropWidth, c.cropHeight, c.focalX, c.focalY)
+		if x != c.cropX || y != c.cropY {
+			t.Errorf("getFocalCropGeometry(%v, %v, %v, %v, %v, %v) = (%d, %d), want (%d, %d)",
+				c.srcWidth, c.srcHeight, c.cropWidth, c.cropHeight, c.focalX, c.focalY, x, y, c.cropX, c.cropY)
+		}
+	}
+}
+
+func TestFocalPointCrop(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 300, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 300; x++ {
+			img.Set(x, y, color.RGBA{128, 128, 128, 255})
+		}
+	}
+	var src bytes.Buffer
+	if err := png.Encode(&src, img); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		width, height int
+		upscale       bool
+		cal           float64
+		focalX        float64
+		want          string
+	}{
+		{100, 100, false, 0, 0.9, "200,0,100,100"},
+		{100, 100, false, 0, 0.3, "40,0,100,100"},
+		// クロップ面積制限で広がった範囲も注目点を中心にする
+		{100, 100, false, 0.5, 0.3, "15,0,150,100"},
+		// 元より大きい場合は upscale の時だけクロップする
+		{600, 600, true, 0, 0.9, "200,0,100,100"},
+		{600, 600, false, 0, 0.9, "0,0,300,100"},
+	}
+	for _, c := range cases {
+		params := ThumbnailParameters{
+			Width:              c.width,
+			Height:             c.height,
+			Upscale:            c.upscale,
+			Quality:            90,
+			Gravity:            5,
+			CropMode:           1,
+			CropAreaLimitation: c.cal,
+			Background:         "white",
+			FormatOutput:       "png",
+			MaxPixels:          1000000,
+			CropDebug:          true,
+			FocalPoint:         true,
+			FocalX:             c.focalX,
+			FocalY:             0.5,
+		}
+		rec := httptest.NewRecorder()
+		if err := MakeThumbnailMagick(src.Bytes(), rec, params); err != nil {
+			t.Fatal(err)
+		}
+		if got := rec.Header().Get("X-Thumber-Crop"); got != c.want {
+			t.Errorf("w=%d,h=%d,u=%v,cal=%g,fx=%g: X-Thumber-Crop = %q, want %q",
+				c.width, c.height, c.upscale, c.cal, c.focalX, got, c.want)
+		}
+	}
+}
+
+func TestJpegSizeHint(t *testing.T) {
+	cases := []struct {
+		cropMode                  int
+		srcWidth, srcHeight       float64
+		cropWidth, cropHeight     float64
+		destWidth, destHeight     float64
+		mappedWidth, mappedHeight float64
+		hint                      string
+	}{
+		// 縮小するだけ
+		{0, 4000, 3000, 0, 0, 400, 300, 400, 300, "800x600"},
+		// 出力が元の半分以上なら縮小してデコードしない
+		{0, 4000, 3000, 0, 0, 2000, 1500, 2000, 1500, ""},
+		// クロップする場合は、クロップした領域を出力サイズにする縮小率
+		{1, 4000, 3000, 3000, 3000, 100, 100, 100, 100, "267x200"},
+		{3, 4000, 3000, 3000, 3000, 100, 100, 100, 100, "267x200"},
+		// 余白をつける場合は、画像が表示される大きさ
+		{2, 4000, 3000, 0, 0, 400, 400, 400, 300, "800x600"},
+		// sc で切り出した領域 (1000x750) を元画像として扱う
+		{0, 1000, 750, 0, 0, 100, 75, 100, 75, "800x600"},
+	}
+	for _, c := range cases {
+		scale := decodeScale(c.cropMode, c.srcWidth, c.srcHeight, c.cropWidth, c.cropHeight, c.destWidth, c.destHeight, c.mappedWidth, c.mappedHeight)
+		if hint := jpegSizeHint(4000, 3000, scale); hint != c.hint {
+			t.Errorf("%+v: jpegSizeHint = %q, want %q", c, hint, c.hint)
+		}
+	}
+}
+
+func TestSourceRegionWithJpegSizeHint(t *testing.T) {
+	// 左半分が赤、右半分が青の 1600x800 の JPEG
+	img := image.NewRGBA(image.Rect(0, 0, 1600, 800))
+	for y := 0; y < 800; y++ {
+		for x := 0; x < 1600; x++ {
+			if x < 800 {
+				img.Set(x, y, color.RGBA{255, 0, 0, 255})
+			} else {
+				img.Set(x, y, color.RGBA{0, 0, 255, 255})
+			}
+		}
+	}
+	var src bytes.Buffer
+	if err := jpeg.Encode(&src, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 縮小してデコードしても、sc とクロップの座標は元画像の座標
+	for _, cropMode := range []int{0, 1, 3} {
+		params := ThumbnailParameters{
+			Width:        20,
+			Height:       20,
+			CropMode:     cropMode,
+			Gravity:      5,
+			Quality:      90,
+			FormatOutput: "png",
+			MaxPixels:    10000000,
+			SourceRegion: SourceRegion{X: 900, Y: 0, Width: 700, Height: 800},
+			CropDebug:    true,
+		}
+		rec := httptest.NewRecorder()
+		if err := MakeThumbnailMagick(src.Bytes(), rec, params); err != nil {
+			t.Fatal(err)
+		}
+		// 20x20 に必要な大きさ (2 倍で 80x40 前後) なので、libjpeg は 1/8 でデコードする
+		if size := rec.Header().Get("X-Thumber-Decode"); size != "200x100" {
+			t.Errorf("cm=%d: decoded at %s, want 200x100", cropMode, size)
+		}
+		out, err := png.Decode(rec.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bounds := out.Bounds()
+		r, _, b, _ := out.At(bounds.Dx()/2, bounds.Dy()/2).RGBA()
+		if r>>8 > 32 || b>>8 < 224 {
+			t.Errorf("cm=%d: the region should be blue, got r=%d b=%d", cropMode, r>>8, b>>8)
+		}
+	}
+}
+
+// testdata/anim.gif は 40x40 の 3 フレーム (表示時間 10, 20, 30, ループ 3 回) で、中央 20x20 以外は透明
+func TestAnimation(t *testing.T) {
+	src, err := ioutil.ReadFile("testdata/anim.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := ThumbnailParameters{
+		Width:              20,
+		Height:             20,
+		Quality:            90,
+		Background:         "white",
+		FormatOutput:       "gif",
+		MaxPixels:          1000000,
+		Animate:            true,
+		MaxAnimationPixels: 40 * 40 * 3,
+	}
+	// クロップする場合は TransformImage で作ったフレームを返すので、それも確かめる
+	for _, cropMode := range []int{0, 1, 3} {
+		params.CropMode = cropMode
+		rec := httptest.NewRecorder()
+		if err := MakeThumbnailMagick(src, rec, params); err != nil {
+			t.Fatalf("cm=%d: %v", cropMode, err)
+		}
+
+		mw := imagick.NewMagickWand()
+		defer mw.Destroy()
+		if err := mw.ReadImageBlob(rec.Body.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		if n := mw.GetNumberImages(); n != 3 {
+			t.Fatalf("cm=%d: %d frames, want 3", cropMode, n)
+		}
+		for i := 0; i < 3; i++ {
+			mw.SetIteratorIndex(i)
+			if delay := mw.GetImageDelay(); delay != uint(10*(i+1)) {
+				t.Errorf("cm=%d frame %d: delay = %d, want %d", cropMode, i, delay, 10*(i+1))
+			}
+			if iterations := mw.GetImageIterations(); iterations != 3 {
+				t.Errorf("cm=%d frame %d: iterations = %d, want 3", cropMode, i, iterations)
+			}
+		}
+
+		// 背景色で塗りつぶさずに透明のまま残す
+		g, err := gif.DecodeAll(bytes.NewReader(rec.Body.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, a := g.Image[0].At(0, 0).RGBA(); a != 0 {
+			t.Errorf("cm=%d: the corner should be transparent, alpha = %d", cropMode, a>>8)
+		}
+		if _, _, _, a := g.Image[0].At(10, 10).RGBA(); a == 0 {
+			t.Errorf("cm=%d: the center should be opaque", cropMode)
+		}
+	}
+	params.CropMode = 0
+
+	// フレーム数 x ピクセル数が上限を超える場合は、デコードする前 (Ping の時点) で断る
+	params.MaxAnimationPixels = 40*40*3 - 1
+	params.Timings = &Timings{}
+	if err := MakeThumbnailMagick(src, httptest.NewRecorder(), params); err == nil {
+		t.Error("the animation over MaxAnimationPixels should be rejected")
+	}
+	if params.Timings.Decode != 0 {
+		t.Error("the animation should be rejected before decoding")
+	}
+
+	// アニメーションしない場合は最初のフレームだけ
+	params.Animate = false
+	rec := httptest.NewRecorder()
+	if err := MakeThumbnailMagick(src, rec, params); err != nil {
+		t.Fatal(err)
+	}
+	if g, err := gif.DecodeAll(bytes.NewReader(rec.Body.Bytes())); err != nil || len(g.Image) != 1 {
+		t.Errorf("anim=0 should make a single frame: %v", err)
+	}
+}
+
+func TestIsOrientationTransposed(t *testing.T) {
+	for orientation, want := range map[imagick.OrientationType]bool{
+		imagick.ORIENTATION_UNDEFINED:    false,
+		imagick.ORIENTATION_TOP_LEFT:     false,
+		imagick.ORIENTATION_TOP_RIGHT:    false,
+		imagick.ORIENTATION_BOTTOM_RIGHT: false,
+		imagick.ORIENTATION_BOTTOM_LEFT:  false,
+		imagick.ORIENTATION_LEFT_TOP:     true,
+		imagick.ORIENTATION_RIGHT_TOP:    true,
+		imagick.ORIENTATION_RIGHT_BOTTOM: true,
+		imagick.ORIENTATION_LEFT_BOTTOM:  true,
+	} {
+		if got := isOrientationTransposed(orientation); got != want {
+			t.Errorf("isOrientationTransposed(%d) = %t", orientation, got)
+		}
+	}
+}
+
+/*
+ *  testdata/orientation-N.jpg は 40x20 で、保存された画素の左上 20x10 が赤、それ以外が青。
+ *  EXIF Orientation 5〜8 を適用すると 20x40 になり、赤い部分は red の位置 (2x2 の区画) に来る。
+ */
+func TestAutoOrient(t *testing.T) {
+	cases := []struct {
+		orientation int
+		red         [2]int
+	}{
+		{5, [2]int{0, 0}}, // 転置
+		{6, [2]int{1, 0}}, // 時計回りに 90度
+		{7, [2]int{1, 1}}, // 逆の転置
+		{8, [2]int{0, 1}}, // 反時計回りに 90度
+	}
+	for _, c := range cases {
+		name := fmt.Sprintf("testdata/orientation-%d.jpg", c.orientation)
+		src, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mw := imagick.NewMagickWand()
+		err = mw.PingImageBlob(src)
+		transposed := isOrientationTransposed(mw.GetImageOrientation())
+		mw.Destroy()
+		if err != nil || !transposed {
+			t.Errorf("%s: orientation should be transposed: %v", name, err)
+		}
+
+		// 縦横を入れ替えて計算するので、縦長の 10x20 にそのまま収まる
+		params := ThumbnailParameters{
+			Width:        10,
+			Height:       20,
+			Quality:      90,
+			Background:   "white",
+			FormatOutput: "png",
+			MaxPixels:    1000000,
+		}
+		rec := httptest.NewRecorder()
+		if err := MakeThumbnailMagick(src, rec, params); err != nil {
+			t.Fatal(name, err)
+		}
+		out, err := png.Decode(rec.Body)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if b := out.Bounds(); b.Dx() != 10 || b.Dy() != 20 {
+			t.Errorf("%s: size = %dx%d, want 10x20", name, b.Dx(), b.Dy())
+			continue
+		}
+		for qy := 0; qy < 2; qy++ {
+			for qx := 0; qx < 2; qx++ {
+				r, _, b, _ := out.At(qx*5+2, qy*10+5).RGBA()
+				isRed := r>>8 > 192 && b>>8 < 64
+				if want := [2]int{qx, qy} == c.red; isRed != want {
+					t.Errorf("%s: area (%d,%d) red = %t, want %t", name, qx, qy, isRed, want)
+				}
+			}
+		}
+	}
+}
+
+// testdata/profiles.jpg は EXIF, XMP, ICC プロファイルを持つ
+func TestStripProfiles(t *testing.T) {
+	src, err := ioutil.ReadFile("testdata/profiles.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	profiles := func(mw *imagick.MagickWand) []string {
+		var names []string
+		for _, name := range mw.GetImageProfiles("*") {
+			names = append(names, strings.ToLower(name))
+		}
+		sort.Strings(names)
+		return names
+	}
+	cases := []struct {
+		keep []string
+		want []string
+	}{
+		{nil, []string{"icc"}},
+		{[]string{"XMP"}, []string{"icc", "xmp"}},
+		{[]string{"exif", "xmp"}, []string{"exif", "icc", "xmp"}},
+	}
+	for _, c := range cases {
+		mw := imagick.NewMagickWand()
+		if err := mw.ReadImageBlob(src); err != nil {
+			t.Fatal(err)
+		}
+		if got := profiles(mw); !reflect.DeepEqual(got, []string{"exif", "icc", "xmp"}) {
+			t.Fatalf("fixture profiles = %q", got)
+		}
+		stripProfiles(mw, c.keep)
+		if got := profiles(mw); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("keep %q: profiles = %q, want %q", c.keep, got, c.want)
+		}
+		mw.Destroy()
+	}
+}